@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/gin-gonic/gin"
+)
+
+// revocations holds revoked tokens, main swaps in a file-backed store when REVOCATION_FILE is set
+var revocations authn.RevocationStore = authn.NewMemoryRevocationStore()
+
+// newTokenID generates a random id, e.g. a jti so a single token can be
+// revoked. It panics when the system has no randomness to offer, rather than
+// hand out the same id twice.
+func newTokenID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic("reading random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// RevocationRequest revokes either one token by jti, or every token of a
+// subject issued before a point in time
+type RevocationRequest struct {
+	JTI       string     `json:"jti"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	Subject   string     `json:"sub"`
+	Before    *time.Time `json:"before"`
+}
+
+// revocationExpiry is how long a revoked jti is remembered: until the token's
+// exp when the request gives it. Otherwise until no token accepted now can
+// still be valid, which only JWT_MAX_AGE bounds: tokens from a JWKS or an
+// introspection endpoint may live far longer than the ones issued here. With
+// neither, the zero time keeps the jti for good.
+func revocationExpiry(req RevocationRequest, now time.Time) time.Time {
+	switch {
+	case req.ExpiresAt != nil:
+		return *req.ExpiresAt
+	case validation.MaxAge > 0:
+		return now.Add(validation.MaxAge + validation.Leeway)
+	}
+	return time.Time{}
+}
+
+// Revoke tokens (admin only)
+func revokeTokens(c *gin.Context) {
+	var req RevocationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	now := time.Now()
+	var err error
+	switch {
+	case req.JTI != "" && req.Subject != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Revoke either a jti or a sub, not both"})
+		return
+	case req.JTI != "":
+		err = revocations.RevokeToken(req.JTI, revocationExpiry(req, now))
+	case req.Subject != "":
+		before := now
+		if req.Before != nil {
+			before = *req.Before
+		}
+		err = revocations.RevokeSubject(req.Subject, before)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "jti or sub is required"})
+		return
+	}
+
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"message": "Token revoked"})
+}
+
+// Get the policy in force (admin only), its version is returned as the ETag
+func getPolicy(c *gin.Context) {
+	source, version := policies.Source()
+	c.Header("ETag", `"`+version+`"`)
+	c.Data(http.StatusOK, "application/yaml", source)
+}
+
+// Replace the policy in force (admin only). An If-Match header makes the
+// update conditional on the version read before. An invalid policy is
+// rejected and the one in force is kept.
+func updatePolicy(c *gin.Context) {
+	data, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var authorizer *authz.Authorizer
+	if match := c.GetHeader("If-Match"); match != "" {
+		authorizer, err = policies.UpdateIf(strings.Trim(match, `"`), data)
+	} else {
+		authorizer, err = policies.Update(data)
+	}
+	switch {
+	case errors.Is(err, authz.ErrVersionMismatch):
+		c.JSON(http.StatusPreconditionFailed, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.Header("ETag", `"`+authorizer.Version()+`"`)
+	c.JSON(http.StatusOK, gin.H{"message": "Policy updated", "version": authorizer.Version()})
+}
+
+// Get how the candidate policy would have decided the requests seen so far (admin only)
+func getShadowStats(c *gin.Context) {
+	if policies.Shadow == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No candidate policy, set SHADOW_POLICY_FILE"})
+		return
+	}
+	c.JSON(http.StatusOK, policies.Shadow.Stats())
+}
+
+// Explain how a hypothetical request would be authorized, without running its
+// handler (admin only). The body is an authz.Request naming the subject, the
+// method, the route and its params, and the resource.
+func (s *server) explainDecision(c *gin.Context) {
+	var req authz.Request
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	decision := policies.Authorizer().Authorize(req)
+	if relation, ok := accountRelations[req.Method+" "+req.Route]; ok && decision.Allowed {
+		checked := s.relations.Decide("account:"+req.Params["id"], relation, req.Subject)
+		decision.Allowed, decision.Reason, decision.Relation = checked.Allowed, checked.Reason, checked.Relation
+	}
+	c.JSON(http.StatusOK, decision)
+}
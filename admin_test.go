@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// Test revoking tokens through the admin endpoint
+func TestRevokeTokens(t *testing.T) {
+	previous := revocations
+	revocations = authn.NewMemoryRevocationStore()
+	defer func() { revocations = previous }()
+
+	r := setupRouter()
+	adminToken, _ := generateJWT("admin1", []string{"admin"}, []string{"admin:write:all"})
+
+	revoke := func(token string, payload RevocationRequest) int {
+		w := httptest.NewRecorder()
+		reqBody, _ := json.Marshal(payload)
+		req, _ := http.NewRequest(http.MethodPost, "/admin/revocations", bytes.NewReader(reqBody))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	getAccount := func(token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/accounts/3", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	jtiOf := func(token string) string {
+		claims := &authz.Claims{}
+		jwt.NewParser().ParseWithClaims(token, claims, authn.Keyfunc(keyProvider))
+		return claims.ID
+	}
+
+	t.Run("Users cannot revoke tokens", func(t *testing.T) {
+		token := generateMockJWT("user3", []string{"user:read:self"})
+		assert.Equal(t, http.StatusForbidden, revoke(token, RevocationRequest{Subject: "user1"}))
+	})
+
+	t.Run("Revoke a single token by jti", func(t *testing.T) {
+		leaked := generateMockJWT("user3", []string{"user:read:self"})
+		other := generateMockJWT("user3", []string{"user:read:self"})
+
+		assert.Equal(t, http.StatusCreated, revoke(adminToken, RevocationRequest{JTI: jtiOf(leaked)}))
+
+		w := getAccount(leaked)
+		assert.Equal(t, http.StatusUnauthorized, w.Code)
+		var response map[string]interface{}
+		json.Unmarshal(w.Body.Bytes(), &response)
+		assert.Equal(t, authn.CodeTokenRevoked, response["code"])
+
+		assert.Equal(t, http.StatusOK, getAccount(other).Code)
+	})
+
+	t.Run("Revoke every token of a subject issued before a time", func(t *testing.T) {
+		old := generateMockJWT("user3", []string{"user:read:self"})
+		before := time.Now().Add(time.Second)
+
+		assert.Equal(t, http.StatusCreated, revoke(adminToken, RevocationRequest{Subject: "user3", Before: &before}))
+		assert.Equal(t, http.StatusUnauthorized, getAccount(old).Code)
+	})
+
+	t.Run("Invalid requests", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, revoke(adminToken, RevocationRequest{}))
+		assert.Equal(t, http.StatusBadRequest, revoke(adminToken, RevocationRequest{JTI: "a", Subject: "b"}))
+	})
+}
+
+// A jti revoked without expires_at is remembered until no token accepted now can be valid
+func TestRevocationExpiry(t *testing.T) {
+	previous := validation
+	defer func() { validation = previous }()
+	now := time.Now()
+	exp := now.Add(time.Hour)
+
+	validation.MaxAge = 0
+	assert.Equal(t, exp, revocationExpiry(RevocationRequest{JTI: "a", ExpiresAt: &exp}, now), "the token's own exp")
+	assert.True(t, revocationExpiry(RevocationRequest{JTI: "a"}, now).IsZero(), "kept for good without JWT_MAX_AGE")
+
+	validation.MaxAge, validation.Leeway = 24*time.Hour, 30*time.Second
+	assert.Equal(t, now.Add(24*time.Hour+30*time.Second), revocationExpiry(RevocationRequest{JTI: "a"}, now))
+}
+
+// Test replacing the policy at runtime through the admin endpoint
+func TestUpdatePolicy(t *testing.T) {
+	previous := policies
+	policies = authz.MustPolicyStore(defaultPolicy, roleRegistry, authz.DefaultMatcher)
+	defer func() { policies = previous }()
+
+	r := setupRouter()
+	adminToken, _ := generateJWT("admin1", []string{"admin"}, nil)
+	userToken := generateMockJWT("user3", []string{"user:read:self"})
+
+	do := func(method, url, token string, body string, header ...string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/admin/policy", adminToken, "")
+	assert.Equal(t, http.StatusOK, w.Code)
+	etag := w.Header().Get("ETag")
+	assert.NotEmpty(t, etag)
+
+	t.Run("Users cannot change the policy", func(t *testing.T) {
+		assert.Equal(t, http.StatusForbidden, do(http.MethodPut, "/admin/policy", userToken, "rules: []").Code)
+	})
+
+	t.Run("Invalid policy keeps the one in force", func(t *testing.T) {
+		w := do(http.MethodPut, "/admin/policy", adminToken, "rules: [{method: GET, path: /accounts/:id, roles: [root]}]")
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, http.StatusOK, do(http.MethodGet, "/accounts/3", userToken, "").Code)
+	})
+
+	t.Run("Stale version is rejected", func(t *testing.T) {
+		w := do(http.MethodPut, "/admin/policy", adminToken, "rules: []", "If-Match", `"stale"`)
+		assert.Equal(t, http.StatusPreconditionFailed, w.Code)
+	})
+
+	t.Run("New policy is enforced", func(t *testing.T) {
+		// Drops the rule for GET /accounts/:id
+		policy := `
+rules:
+  - {method: GET, path: /admin/policy, scopes: [admin:read:all]}
+  - {method: PUT, path: /admin/policy, scopes: [admin:write:all]}
+`
+		w := do(http.MethodPut, "/admin/policy", adminToken, policy, "If-Match", etag)
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEqual(t, etag, w.Header().Get("ETag"))
+		assert.Equal(t, http.StatusForbidden, do(http.MethodGet, "/accounts/3", userToken, "").Code)
+	})
+}
+
+func TestExplainDecision(t *testing.T) {
+	r := setupRouter()
+	adminToken, _ := generateJWT("admin1", []string{"admin"}, nil)
+
+	tests := []struct {
+		name     string
+		body     string
+		allowed  bool
+		expected map[string]interface{}
+	}{
+		{
+			name:     "Missing scope",
+			body:     `{"method":"PUT","route":"/accounts/:id","params":{"id":"3"},"subject":{"user_id":"user3","scopes":["user:read:self"]}}`,
+			expected: map[string]interface{}{"reason": "missing scope", "missing_scopes": []interface{}{"user:write:self"}},
+		},
+		{
+			name:     "Missing relation",
+			body:     `{"method":"GET","route":"/accounts/:id","params":{"id":"3"},"subject":{"user_id":"user2","roles":["user"]}}`,
+			expected: map[string]interface{}{"reason": "user:user2 is not viewer of account:3", "relation": "account:3#viewer"},
+		},
+		{
+			name:     "Delegated viewer",
+			body:     `{"method":"GET","route":"/accounts/:id","params":{"id":"3"},"subject":{"user_id":"user5","roles":["user"]}}`,
+			allowed:  true,
+			expected: map[string]interface{}{"relation": "account:3#viewer"},
+		},
+		{
+			name:     "Route without a rule",
+			body:     `{"method":"GET","route":"/unlisted","subject":{"user_id":"admin1","roles":["admin"]}}`,
+			expected: map[string]interface{}{"reason": "no rule for GET /unlisted", "roles": []interface{}{"admin", "user"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/authz/explain", strings.NewReader(tt.body))
+			req.Header.Set("Authorization", "Bearer "+adminToken)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var decision map[string]interface{}
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &decision))
+			assert.Equal(t, tt.allowed, decision["allowed"])
+			for key, value := range tt.expected {
+				assert.Equal(t, value, decision[key], key)
+			}
+		})
+	}
+
+	t.Run("Users cannot explain", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPost, "/authz/explain", strings.NewReader(tests[0].body))
+		req.Header.Set("Authorization", "Bearer "+generateMockJWT("user3", []string{"user:read:self"}))
+		r.ServeHTTP(w, req)
+		assert.Equal(t, http.StatusForbidden, w.Code)
+	})
+}
+
+func TestDecisionHeader(t *testing.T) {
+	previous := policies
+	policies = authz.MustPolicyStore(defaultPolicy, roleRegistry, authz.DefaultMatcher)
+	policies.Debug = true
+	defer func() { policies = previous }()
+	r := setupRouter()
+
+	token, _ := generateJWT("user3", nil, []string{"user:read:self"})
+	do := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodPut, "/accounts/3", strings.NewReader(`{"name":"x"}`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do()
+	assert.Equal(t, http.StatusForbidden, w.Code)
+
+	var decision authz.Decision
+	assert.NoError(t, json.Unmarshal([]byte(w.Header().Get(authz.DecisionHeader)), &decision))
+	assert.Equal(t, "missing scope", decision.Reason)
+	assert.Equal(t, []string{"user:write:self"}, decision.MissingScopes)
+
+	policies.Debug = false
+	w = do()
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Empty(t, w.Header().Get(authz.DecisionHeader))
+}
+
+func TestShadowStats(t *testing.T) {
+	previous := policies
+	policies = authz.MustPolicyStore(defaultPolicy, roleRegistry, authz.DefaultMatcher)
+	defer func() { policies = previous }()
+	r := setupRouter()
+	adminToken, _ := generateJWT("admin1", []string{"admin"}, nil)
+
+	get := func(url, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusNotFound, get("/admin/policy/shadow", adminToken).Code)
+
+	// The candidate drops the rule for reading an account
+	policies.Shadow = authz.NewShadow(authz.MustPolicyStore([]byte(`
+rules:
+  - {method: GET, path: /admin/policy/shadow, scopes: [admin:read:all]}
+`), roleRegistry, authz.DefaultMatcher))
+
+	userToken, _ := generateJWT("user3", []string{"user"}, nil)
+	assert.Equal(t, http.StatusOK, get("/accounts/3", userToken).Code)
+
+	w := get("/admin/policy/shadow", adminToken)
+	assert.Equal(t, http.StatusOK, w.Code)
+	var stats authz.ShadowStats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &stats))
+	assert.Equal(t, int64(2), stats.Evaluated)
+	assert.Equal(t, int64(1), stats.WouldDeny)
+	assert.Equal(t, int64(1), stats.Routes["GET /accounts/:id"].WouldDeny)
+}
@@ -0,0 +1,124 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrNoKeys is returned by KeySetFromEnv when no key is configured
+var ErrNoKeys = errors.New("no signing key configured")
+
+// DevModeFromEnv reads from DEV_TOKEN_ENDPOINT whether the server runs in
+// development mode, off by default. Only then may it fall back to the
+// development secret, and the first server serve POST /oauth/token.
+func DevModeFromEnv() (bool, error) {
+	value := os.Getenv("DEV_TOKEN_ENDPOINT")
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// KeySetFromEnv builds a KeySet from the environment:
+//
+//	JWT_KEY_ID            kid of the signing key
+//	JWT_SECRET            HMAC secret
+//	JWT_SECRET_FILE       file holding the HMAC secret
+//	JWT_PRIVATE_KEY_FILE  PEM encoded RSA or ECDSA private key
+//	JWT_VERIFY_KEYS       extra PEM verification keys, comma separated kid=path pairs
+//	JWT_VERIFY_SECRET_FILES  extra HMAC secrets, comma separated kid=path pairs
+//
+// Exactly one of JWT_SECRET, JWT_SECRET_FILE and JWT_PRIVATE_KEY_FILE must be set.
+func KeySetFromEnv() (*KeySet, error) {
+	kid := os.Getenv("JWT_KEY_ID")
+
+	var sources []string
+	for _, name := range []string{"JWT_SECRET", "JWT_SECRET_FILE", "JWT_PRIVATE_KEY_FILE"} {
+		if os.Getenv(name) != "" {
+			sources = append(sources, name)
+		}
+	}
+	switch len(sources) {
+	case 0:
+		return nil, ErrNoKeys
+	case 1:
+	default:
+		return nil, fmt.Errorf("only one signing key may be configured, got %s", strings.Join(sources, ", "))
+	}
+
+	var active *Key
+	var err error
+	switch sources[0] {
+	case "JWT_SECRET":
+		active = NewHMACKey(kid, []byte(os.Getenv("JWT_SECRET")))
+	case "JWT_SECRET_FILE":
+		active, err = HMACKeyFromFile(kid, os.Getenv("JWT_SECRET_FILE"))
+	case "JWT_PRIVATE_KEY_FILE":
+		active, err = KeyFromFile(kid, os.Getenv("JWT_PRIVATE_KEY_FILE"))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	set := NewKeySet(active)
+	// Secrets are listed apart from PEM keys, a public key mistaken for a
+	// secret would let anyone who has it sign tokens
+	for name, load := range map[string]func(kid, path string) (*Key, error){
+		"JWT_VERIFY_KEYS":         KeyFromFile,
+		"JWT_VERIFY_SECRET_FILES": HMACKeyFromFile,
+	} {
+		if err := addKeysFromEnv(set, name, load); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
+// addKeysFromEnv adds the keys the variable name lists as kid=path pairs
+func addKeysFromEnv(set *KeySet, name string, load func(kid, path string) (*Key, error)) error {
+	extra := os.Getenv(name)
+	if extra == "" {
+		return nil
+	}
+	for _, pair := range strings.Split(extra, ",") {
+		id, path, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || id == "" {
+			return fmt.Errorf("%s: expected kid=path, got %q", name, pair)
+		}
+		key, err := load(id, path)
+		if err != nil {
+			return err
+		}
+		set.Add(key)
+	}
+	return nil
+}
+
+// HMACKeyFromFile reads an HMAC secret from a file, ignoring surrounding whitespace
+func HMACKeyFromFile(kid, path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	secret := strings.TrimSpace(string(data))
+	if secret == "" {
+		return nil, fmt.Errorf("secret file %s is empty", path)
+	}
+	return NewHMACKey(kid, []byte(secret)), nil
+}
+
+// KeyFromFile reads a PEM encoded RSA or ECDSA key from a file
+func KeyFromFile(kid, path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePEM(kid, data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return key, nil
+}
@@ -0,0 +1,280 @@
+package authn
+
+import (
+	"container/heap"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Error codes reported by Introspector
+const (
+	CodeTokenInactive       = "token_inactive"
+	CodeIntrospectionFailed = "introspection_failed"
+)
+
+// Introspection is the part of an RFC 7662 introspection response mapped onto claims
+type Introspection struct {
+	Active    bool
+	Subject   string
+	UserID    string
+	Scopes    []string
+	Roles     []string
+	ID        string
+	Issuer    string
+	Audience  []string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// Raw holds every field of the response
+	Raw map[string]interface{}
+}
+
+// DefaultIntrospectionCacheSize is how many results an Introspector keeps when CacheSize is not set
+const DefaultIntrospectionCacheSize = 10000
+
+// Introspector authenticates opaque tokens by asking the authorization
+// server about them (RFC 7662). Active results are cached until the token's exp.
+type Introspector struct {
+	// Endpoint is the introspection URL
+	Endpoint string
+	// ClientID and ClientSecret authenticate this service with HTTP Basic auth
+	ClientID     string
+	ClientSecret string
+	// RolesField names the response field holding the roles, dots descend
+	// into nested objects, e.g. realm_access.roles
+	RolesField string
+	// UserIDField names the response field holding the user id, sub by default
+	UserIDField string
+	Client      *http.Client
+	// CacheSize caps the cached results, DefaultIntrospectionCacheSize when zero.
+	// A full cache drops the results that expire first, expired ones included.
+	CacheSize int
+
+	mu    sync.Mutex
+	cache map[string]*cacheEntry
+	// expiries orders the cached results by exp, the first to expire on top
+	expiries expiryHeap
+	now      func() time.Time
+}
+
+// cacheEntry is a cached result and its place in the expiry heap
+type cacheEntry struct {
+	key    string
+	result *Introspection
+	index  int
+}
+
+// expiryHeap implements heap.Interface, ordered by ExpiresAt
+type expiryHeap []*cacheEntry
+
+func (h expiryHeap) Len() int { return len(h) }
+func (h expiryHeap) Less(a, b int) bool {
+	return h[a].result.ExpiresAt.Before(h[b].result.ExpiresAt)
+}
+func (h expiryHeap) Swap(a, b int) {
+	h[a], h[b] = h[b], h[a]
+	h[a].index, h[b].index = a, b
+}
+func (h *expiryHeap) Push(x interface{}) {
+	entry := x.(*cacheEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// NewIntrospector creates an Introspector for endpoint reading roles from the roles field
+func NewIntrospector(endpoint, clientID, clientSecret string) *Introspector {
+	return &Introspector{
+		Endpoint:     endpoint,
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		RolesField:   "roles",
+		UserIDField:  "sub",
+		Client:       &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// LooksLikeJWT reports whether a token has the three dot separated segments of
+// a JWS, anything else is treated as opaque
+func LooksLikeJWT(token string) bool {
+	return strings.Count(token, ".") == 2
+}
+
+// Introspect returns the active introspection result for token, or a
+// ValidationError when the token is inactive or the server cannot be reached
+func (i *Introspector) Introspect(ctx context.Context, token string) (*Introspection, error) {
+	key := hashToken(token)
+	if cached := i.cached(key); cached != nil {
+		return cached, nil
+	}
+
+	form := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, i.Endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if i.ClientID != "" {
+		req.SetBasicAuth(url.QueryEscape(i.ClientID), url.QueryEscape(i.ClientSecret))
+	}
+
+	resp, err := i.Client.Do(req)
+	if err != nil {
+		return nil, validationError(CodeIntrospectionFailed, "token introspection failed: %s", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, validationError(CodeIntrospectionFailed, "token introspection failed: %s", resp.Status)
+	}
+
+	var raw map[string]interface{}
+	if err := json.NewDecoder(resp.Body).Decode(&raw); err != nil {
+		return nil, validationError(CodeIntrospectionFailed, "token introspection failed: %s", err)
+	}
+
+	result := i.parse(raw)
+	if !result.Active {
+		return nil, validationError(CodeTokenInactive, "token is not active")
+	}
+	if !result.ExpiresAt.IsZero() && !i.clock().Before(result.ExpiresAt) {
+		return nil, validationError(CodeTokenExpired, "token is expired")
+	}
+
+	// Without exp there is no safe point to stop trusting the answer, so it is not cached
+	if !result.ExpiresAt.IsZero() {
+		i.store(key, result)
+	}
+	return result, nil
+}
+
+// Validate enforces the issuers and audiences of opts, the same as Verify
+// does for a JWT. The authorization server has checked the rest.
+func (r *Introspection) Validate(opts ValidationOptions) error {
+	return checkIssuerAndAudience(r.Issuer, r.Audience, opts)
+}
+
+func (i *Introspector) cached(key string) *Introspection {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	entry, ok := i.cache[key]
+	if !ok {
+		return nil
+	}
+	if !i.clock().Before(entry.result.ExpiresAt) {
+		delete(i.cache, key)
+		heap.Remove(&i.expiries, entry.index)
+		return nil
+	}
+	return entry.result
+}
+
+// store caches result. A full cache forgets the results that expire first,
+// expired ones included, in O(log n) each.
+func (i *Introspector) store(key string, result *Introspection) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.cache == nil {
+		i.cache = map[string]*cacheEntry{}
+	}
+
+	if entry, ok := i.cache[key]; ok {
+		entry.result = result
+		heap.Fix(&i.expiries, entry.index)
+		return
+	}
+
+	size := i.CacheSize
+	if size <= 0 {
+		size = DefaultIntrospectionCacheSize
+	}
+	for len(i.cache) >= size {
+		first := heap.Pop(&i.expiries).(*cacheEntry)
+		delete(i.cache, first.key)
+	}
+	entry := &cacheEntry{key: key, result: result}
+	i.cache[key] = entry
+	heap.Push(&i.expiries, entry)
+}
+
+func (i *Introspector) clock() time.Time {
+	if i.now != nil {
+		return i.now()
+	}
+	return time.Now()
+}
+
+func (i *Introspector) parse(raw map[string]interface{}) *Introspection {
+	result := &Introspection{Raw: raw}
+	result.Active, _ = raw["active"].(bool)
+	result.Subject, _ = raw["sub"].(string)
+	result.ID, _ = raw["jti"].(string)
+	result.Issuer, _ = raw["iss"].(string)
+	// aud is one string or a list of them, as in a JWT
+	switch aud := raw["aud"].(type) {
+	case string:
+		result.Audience = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				result.Audience = append(result.Audience, s)
+			}
+		}
+	}
+	if scope, ok := raw["scope"].(string); ok {
+		result.Scopes = strings.Fields(scope)
+	}
+	if exp, ok := raw["exp"].(float64); ok {
+		result.ExpiresAt = time.Unix(int64(exp), 0)
+	}
+	if iat, ok := raw["iat"].(float64); ok {
+		result.IssuedAt = time.Unix(int64(iat), 0)
+	}
+
+	userIDField := i.UserIDField
+	if userIDField == "" {
+		userIDField = "sub"
+	}
+	if userID, ok := lookupField(raw, userIDField).(string); ok {
+		result.UserID = userID
+	}
+
+	switch roles := lookupField(raw, i.RolesField).(type) {
+	case []interface{}:
+		for _, role := range roles {
+			if s, ok := role.(string); ok {
+				result.Roles = append(result.Roles, s)
+			}
+		}
+	case string:
+		result.Roles = strings.Fields(roles)
+	}
+	return result
+}
+
+// lookupField follows a dotted path through nested JSON objects
+func lookupField(raw map[string]interface{}, path string) interface{} {
+	if path == "" {
+		return nil
+	}
+	var value interface{} = raw
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = object[part]
+	}
+	return value
+}
@@ -0,0 +1,155 @@
+package authn
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// introspectionServer is an httptest stand-in for an RFC 7662 endpoint
+func introspectionServer(t *testing.T, responses map[string]map[string]interface{}) (*httptest.Server, *atomic.Int32) {
+	t.Helper()
+	var hits atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		if id, secret, ok := r.BasicAuth(); !ok || id != "accounts-api" || secret != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response, ok := responses[r.PostFormValue("token")]
+		if !ok {
+			response = map[string]interface{}{"active": false}
+		}
+		json.NewEncoder(w).Encode(response)
+	}))
+	t.Cleanup(server.Close)
+	return server, &hits
+}
+
+func TestIntrospect(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	server, hits := introspectionServer(t, map[string]map[string]interface{}{
+		"opaque-1": {
+			"active":       true,
+			"sub":          "f1c2",
+			"username":     "user1",
+			"scope":        "user:read:self user:write:self",
+			"realm_access": map[string]interface{}{"roles": []string{"user"}},
+			"jti":          "jti-1",
+			"exp":          exp,
+		},
+		"no-exp": {"active": true, "sub": "user2"},
+	})
+
+	introspector := NewIntrospector(server.URL, "accounts-api", "s3cr3t")
+	introspector.RolesField = "realm_access.roles"
+	introspector.UserIDField = "username"
+
+	result, err := introspector.Introspect(context.Background(), "opaque-1")
+	assert.NoError(t, err)
+	assert.Equal(t, "f1c2", result.Subject)
+	assert.Equal(t, "user1", result.UserID)
+	assert.Equal(t, []string{"user:read:self", "user:write:self"}, result.Scopes)
+	assert.Equal(t, []string{"user"}, result.Roles)
+	assert.Equal(t, "jti-1", result.ID)
+	assert.Equal(t, exp, result.ExpiresAt.Unix())
+
+	t.Run("active results are cached until exp", func(t *testing.T) {
+		hits.Store(0)
+		introspector.Introspect(context.Background(), "opaque-1")
+		assert.Equal(t, int32(0), hits.Load())
+
+		introspector.now = func() time.Time { return time.Unix(exp, 0) }
+		defer func() { introspector.now = nil }()
+		_, err := introspector.Introspect(context.Background(), "opaque-1")
+		assert.Equal(t, CodeTokenExpired, ErrorCode(err))
+		assert.Equal(t, int32(1), hits.Load())
+	})
+
+	t.Run("results without exp are not cached", func(t *testing.T) {
+		hits.Store(0)
+		introspector.Introspect(context.Background(), "no-exp")
+		introspector.Introspect(context.Background(), "no-exp")
+		assert.Equal(t, int32(2), hits.Load())
+	})
+
+	t.Run("inactive token", func(t *testing.T) {
+		_, err := introspector.Introspect(context.Background(), "revoked")
+		assert.Equal(t, CodeTokenInactive, ErrorCode(err))
+	})
+
+	t.Run("bad client credentials", func(t *testing.T) {
+		_, err := NewIntrospector(server.URL, "accounts-api", "wrong").Introspect(context.Background(), "opaque-1")
+		assert.Equal(t, CodeIntrospectionFailed, ErrorCode(err))
+	})
+}
+
+// Introspected tokens meet the same iss and aud checks as JWTs
+func TestIntrospectionValidate(t *testing.T) {
+	introspector := &Introspector{}
+	opts := ValidationOptions{Issuers: []string{"keycloak"}, Audiences: []string{"accounts-api"}}
+
+	tests := []struct {
+		name     string
+		raw      map[string]interface{}
+		expected string
+	}{
+		{name: "audience list", raw: map[string]interface{}{"iss": "keycloak", "aud": []interface{}{"billing", "accounts-api"}}},
+		{name: "single audience", raw: map[string]interface{}{"iss": "keycloak", "aud": "accounts-api"}},
+		{name: "other issuer", raw: map[string]interface{}{"iss": "elsewhere", "aud": "accounts-api"}, expected: CodeInvalidIssuer},
+		{name: "other audience", raw: map[string]interface{}{"iss": "keycloak", "aud": "billing"}, expected: CodeInvalidAudience},
+		{name: "no audience", raw: map[string]interface{}{"iss": "keycloak"}, expected: CodeInvalidAudience},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := introspector.parse(tt.raw).Validate(opts)
+			if tt.expected == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, tt.expected, ErrorCode(err))
+		})
+	}
+}
+
+// A full cache drops expired results first, then the ones expiring soonest
+func TestIntrospectionCacheSize(t *testing.T) {
+	now := time.Now()
+	introspector := &Introspector{CacheSize: 2, now: func() time.Time { return now }}
+	result := func(expiresIn time.Duration) *Introspection {
+		return &Introspection{Active: true, ExpiresAt: now.Add(expiresIn)}
+	}
+
+	introspector.store("soon", result(time.Minute))
+	introspector.store("later", result(time.Hour))
+	introspector.store("latest", result(2*time.Hour))
+	assert.Len(t, introspector.cache, 2)
+	assert.Nil(t, introspector.cached("soon"))
+	assert.NotNil(t, introspector.cached("later"))
+
+	now = now.Add(90 * time.Minute)
+	introspector.store("new", result(time.Hour))
+	assert.Len(t, introspector.cache, 2)
+	assert.Nil(t, introspector.cached("later"))
+	assert.NotNil(t, introspector.cached("latest"))
+	assert.NotNil(t, introspector.cached("new"))
+
+	// A result stored again moves in the order, so "latest" expires first now
+	introspector.store("new", result(3*time.Hour))
+	introspector.store("newest", result(4*time.Hour))
+	assert.Nil(t, introspector.cached("latest"))
+	assert.NotNil(t, introspector.cached("new"))
+	assert.Len(t, introspector.expiries, len(introspector.cache))
+}
+
+func TestLooksLikeJWT(t *testing.T) {
+	assert.True(t, LooksLikeJWT("eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.c2ln"))
+	assert.False(t, LooksLikeJWT("2YotnFZFEjr1zCsicMWpAA"))
+}
@@ -0,0 +1,390 @@
+package authn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWK is a single JSON Web Key (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// ECDSA
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+// JWKSet is the document served by a JWKS endpoint
+type JWKSet struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+// Key converts the JWK into a verification key
+func (j JWK) Key() (*Key, error) {
+	var key *Key
+	switch j.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(j.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %q: invalid n: %w", j.Kid, err)
+		}
+		e, err := b64.DecodeString(j.E)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %q: invalid e: %w", j.Kid, err)
+		}
+		key, err = NewKey(j.Kid, &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())})
+		if err != nil {
+			return nil, err
+		}
+	case "EC":
+		var curve elliptic.Curve
+		switch j.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("jwk %q: unsupported curve %q", j.Kid, j.Crv)
+		}
+		x, err := b64.DecodeString(j.X)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %q: invalid x: %w", j.Kid, err)
+		}
+		y, err := b64.DecodeString(j.Y)
+		if err != nil {
+			return nil, fmt.Errorf("jwk %q: invalid y: %w", j.Kid, err)
+		}
+		key, err = NewKey(j.Kid, &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)})
+		if err != nil {
+			return nil, err
+		}
+	case "oct":
+		// A secret shared through a key set is no secret, anyone who can read it can sign
+		return nil, fmt.Errorf("jwk %q: symmetric keys are not accepted", j.Kid)
+	default:
+		return nil, fmt.Errorf("jwk %q: unsupported key type %q", j.Kid, j.Kty)
+	}
+
+	// The key's own alg wins over the default picked from its type, e.g. RS384
+	// or PS256, as long as it signs with that type of key
+	if j.Alg != "" {
+		method := jwt.GetSigningMethod(j.Alg)
+		if method == nil {
+			return nil, fmt.Errorf("jwk %q: unsupported alg %q", j.Kid, j.Alg)
+		}
+		if !signsWith(method, key) {
+			return nil, fmt.Errorf("jwk %q: alg %q does not match the %s key", j.Kid, j.Alg, key.Method.Alg())
+		}
+		key.Method = method
+	}
+	return key, nil
+}
+
+// signsWith reports whether method verifies with key: RS and PS algorithms
+// for an RSA key, the ES algorithm of its curve for an EC key
+func signsWith(method jwt.SigningMethod, key *Key) bool {
+	switch key.Public.(type) {
+	case *rsa.PublicKey:
+		switch method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS:
+			return true
+		}
+	case *ecdsa.PublicKey:
+		return method.Alg() == key.Method.Alg()
+	}
+	return false
+}
+
+// JWK returns the public half of the key as a JWK. HMAC keys have no public
+// half and are refused.
+func (k *Key) JWK() (JWK, error) {
+	jwk := JWK{Kid: k.ID, Use: "sig", Alg: k.Method.Alg()}
+	switch pub := k.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(pub.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case *ecdsa.PublicKey:
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		jwk.Kty = "EC"
+		jwk.Crv = pub.Curve.Params().Name
+		jwk.X = b64.EncodeToString(pub.X.FillBytes(make([]byte, size)))
+		jwk.Y = b64.EncodeToString(pub.Y.FillBytes(make([]byte, size)))
+	default:
+		return JWK{}, fmt.Errorf("unsupported key type %T", k.Public)
+	}
+	return jwk, nil
+}
+
+// JWKS is a KeyProvider backed by a JSON Web Key Set loaded from a URL or a
+// local file. The set is cached, refreshed on a schedule once started, and
+// refreshed early when a token references a kid that is not in the cache.
+type JWKS struct {
+	source          string
+	client          *http.Client
+	refreshInterval time.Duration
+	minRefresh      time.Duration
+	// errorLog receives the errors of scheduled refreshes and skipped keys
+	errorLog func(err error)
+
+	mu   sync.RWMutex
+	keys map[string]*Key
+	// attemptedAt is when the set was last fetched, successfully or not
+	attemptedAt time.Time
+
+	refreshMu sync.Mutex
+	stop      chan struct{}
+	stopOnce  sync.Once
+}
+
+// JWKSOption configures a JWKS
+type JWKSOption func(*JWKS)
+
+// WithHTTPClient sets the client used to fetch a remote key set
+func WithHTTPClient(client *http.Client) JWKSOption {
+	return func(j *JWKS) { j.client = client }
+}
+
+// WithRefreshInterval sets how often Start reloads the key set
+func WithRefreshInterval(d time.Duration) JWKSOption {
+	return func(j *JWKS) { j.refreshInterval = d }
+}
+
+// WithMinRefreshInterval limits how often an unknown kid may trigger a reload
+func WithMinRefreshInterval(d time.Duration) JWKSOption {
+	return func(j *JWKS) { j.minRefresh = d }
+}
+
+// WithErrorLog receives the errors of the refreshes Start schedules and the
+// keys a refresh skips, they are dropped without it
+func WithErrorLog(log func(err error)) JWKSOption {
+	return func(j *JWKS) { j.errorLog = log }
+}
+
+// NewJWKS loads the key set from source, an http(s) URL or a file path
+func NewJWKS(source string, opts ...JWKSOption) (*JWKS, error) {
+	j := &JWKS{
+		source:          source,
+		client:          &http.Client{Timeout: 10 * time.Second},
+		refreshInterval: time.Hour,
+		minRefresh:      time.Minute,
+		stop:            make(chan struct{}),
+	}
+	for _, opt := range opts {
+		opt(j)
+	}
+	if err := j.Refresh(); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// Refresh reloads the key set. On failure the previously cached keys stay in use.
+func (j *JWKS) Refresh() error {
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+	return j.refresh()
+}
+
+// refresh reloads the key set, the caller holds refreshMu
+func (j *JWKS) refresh() error {
+	j.mu.Lock()
+	j.attemptedAt = time.Now()
+	j.mu.Unlock()
+
+	data, err := j.fetch()
+	if err != nil {
+		return fmt.Errorf("jwks %s: %w", j.source, err)
+	}
+
+	var set JWKSet
+	if err := json.Unmarshal(data, &set); err != nil {
+		return fmt.Errorf("jwks %s: %w", j.source, err)
+	}
+
+	// A key this package cannot use is skipped, so the issuer adding one does
+	// not stop the rotation of the others
+	keys := map[string]*Key{}
+	var skipped []error
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.Key()
+		if err != nil {
+			skipped = append(skipped, err)
+			j.logError(fmt.Errorf("jwks %s: skipping key: %w", j.source, err))
+			continue
+		}
+		keys[key.ID] = key
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("jwks %s: no usable signing keys: %w", j.source, errors.Join(skipped...))
+	}
+
+	j.mu.Lock()
+	j.keys = keys
+	j.mu.Unlock()
+	return nil
+}
+
+func (j *JWKS) fetch() ([]byte, error) {
+	if !strings.HasPrefix(j.source, "http://") && !strings.HasPrefix(j.source, "https://") {
+		return os.ReadFile(strings.TrimPrefix(j.source, "file://"))
+	}
+
+	resp, err := j.client.Get(j.source)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// Key implements KeyProvider. An unknown kid reloads the set, at most once per
+// minimum refresh interval, to pick up keys the issuer has just rotated in.
+// Failed reloads count too, so tokens with made up kids cannot flood the issuer.
+func (j *JWKS) Key(kid string) (*Key, error) {
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	if !j.due() {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+
+	j.refreshMu.Lock()
+	defer j.refreshMu.Unlock()
+	// Another request may have reloaded the set while this one waited
+	if key, ok := j.lookup(kid); ok {
+		return key, nil
+	}
+	if j.due() {
+		if err := j.refresh(); err != nil {
+			return nil, err
+		}
+		if key, ok := j.lookup(kid); ok {
+			return key, nil
+		}
+	}
+	return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+}
+
+// due reports whether the minimum refresh interval has passed since the last attempt
+func (j *JWKS) due() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return time.Since(j.attemptedAt) >= j.minRefresh
+}
+
+func (j *JWKS) lookup(kid string) (*Key, bool) {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+
+	// Tokens without a kid are only unambiguous when the set holds one key
+	if kid == "" && len(j.keys) == 1 {
+		for _, key := range j.keys {
+			return key, true
+		}
+	}
+	key, ok := j.keys[kid]
+	return key, ok
+}
+
+// Start reloads the key set every refresh interval until Stop is called
+func (j *JWKS) Start() {
+	go func() {
+		ticker := time.NewTicker(j.refreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := j.Refresh(); err != nil {
+					j.logError(err)
+				}
+			case <-j.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (j *JWKS) logError(err error) {
+	if j.errorLog != nil {
+		j.errorLog(err)
+	}
+}
+
+// Stop ends the background refresh started by Start
+func (j *JWKS) Stop() {
+	j.stopOnce.Do(func() { close(j.stop) })
+}
+
+// Providers tries each KeyProvider in order and returns the first key found
+type Providers []KeyProvider
+
+// Key implements KeyProvider
+func (p Providers) Key(kid string) (*Key, error) {
+	err := fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	for _, provider := range p {
+		key, keyErr := provider.Key(kid)
+		if keyErr == nil {
+			return key, nil
+		}
+		if !errors.Is(keyErr, ErrUnknownKey) {
+			err = keyErr
+		}
+	}
+	return nil, err
+}
+
+// JWKSFromEnv loads the key set named by JWT_JWKS_URL, a URL or file path,
+// refreshed every JWT_JWKS_REFRESH (a Go duration, one hour by default).
+// It returns ErrNoKeys when JWT_JWKS_URL is not set.
+func JWKSFromEnv(opts ...JWKSOption) (*JWKS, error) {
+	source := os.Getenv("JWT_JWKS_URL")
+	if source == "" {
+		return nil, ErrNoKeys
+	}
+
+	if refresh := os.Getenv("JWT_JWKS_REFRESH"); refresh != "" {
+		d, err := time.ParseDuration(refresh)
+		if err != nil {
+			return nil, fmt.Errorf("JWT_JWKS_REFRESH: %w", err)
+		}
+		if d <= 0 {
+			return nil, fmt.Errorf("JWT_JWKS_REFRESH must be positive")
+		}
+		opts = append(opts, WithRefreshInterval(d))
+	}
+	return NewJWKS(source, opts...)
+}
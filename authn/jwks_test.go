@@ -0,0 +1,285 @@
+package authn
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// jwksServer is an httptest stand-in for an issuer's JWKS endpoint
+type jwksServer struct {
+	*httptest.Server
+	mu   sync.Mutex
+	keys []*Key
+	hits atomic.Int32
+}
+
+func newJWKSServer(t *testing.T, keys ...*Key) *jwksServer {
+	t.Helper()
+	s := &jwksServer{keys: keys}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.hits.Add(1)
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		json.NewEncoder(w).Encode(marshalKeys(t, s.keys...))
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+func (s *jwksServer) rotate(keys ...*Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = keys
+}
+
+func marshalKeys(t *testing.T, keys ...*Key) JWKSet {
+	t.Helper()
+	var set JWKSet
+	for _, k := range keys {
+		jwk, err := k.JWK()
+		assert.NoError(t, err)
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func TestJWKSVerifiesRSAAndECDSA(t *testing.T) {
+	rsaKey, _ := ParsePEM("rsa-1", rsaPEM(t))
+	ecKey, _ := ParsePEM("ec-1", ecdsaPEM(t))
+	server := newJWKSServer(t, rsaKey, ecKey)
+
+	jwks, err := NewJWKS(server.URL)
+	assert.NoError(t, err)
+
+	for _, key := range []*Key{rsaKey, ecKey} {
+		token, _ := key.Sign(testClaims())
+		assert.NoError(t, parse(t, jwks, token), key.ID)
+	}
+	assert.Equal(t, int32(1), server.hits.Load(), "keys should be served from the cache")
+}
+
+func TestJWKSRefreshesOnUnknownKid(t *testing.T) {
+	oldKey, _ := ParsePEM("k1", rsaPEM(t))
+	newKey, _ := ParsePEM("k2", rsaPEM(t))
+	server := newJWKSServer(t, oldKey)
+
+	jwks, err := NewJWKS(server.URL, WithMinRefreshInterval(0))
+	assert.NoError(t, err)
+
+	server.rotate(oldKey, newKey)
+	token, _ := newKey.Sign(testClaims())
+	assert.NoError(t, parse(t, jwks, token))
+	assert.Equal(t, int32(2), server.hits.Load())
+}
+
+func TestJWKSRateLimitsUnknownKid(t *testing.T) {
+	key, _ := ParsePEM("k1", rsaPEM(t))
+	server := newJWKSServer(t, key)
+
+	jwks, err := NewJWKS(server.URL, WithMinRefreshInterval(time.Hour))
+	assert.NoError(t, err)
+
+	for i := 0; i < 3; i++ {
+		_, err := jwks.Key("missing")
+		assert.ErrorIs(t, err, ErrUnknownKey)
+	}
+	assert.Equal(t, int32(1), server.hits.Load())
+}
+
+// Failed reloads count against the minimum refresh interval too
+func TestJWKSRateLimitsFailedRefresh(t *testing.T) {
+	key, _ := ParsePEM("k1", rsaPEM(t))
+	server := newJWKSServer(t, key)
+
+	jwks, err := NewJWKS(server.URL, WithMinRefreshInterval(time.Hour))
+	assert.NoError(t, err)
+	jwks.mu.Lock()
+	jwks.attemptedAt = time.Time{}
+	jwks.mu.Unlock()
+	server.Close()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := jwks.Key("missing")
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	// Only the first request tried the closed server, the others were turned away
+	unknown := 0
+	for err := range errs {
+		if errors.Is(err, ErrUnknownKey) {
+			unknown++
+		}
+	}
+	assert.Equal(t, 9, unknown)
+	assert.False(t, jwks.due())
+}
+
+// A key set must not hand out secrets that sign tokens
+func TestJWKSRejectsSymmetricKeys(t *testing.T) {
+	_, err := JWK{Kty: "oct", Kid: "hmac-1"}.Key()
+	assert.ErrorContains(t, err, "symmetric keys are not accepted")
+
+	_, err = NewHMACKey("hmac-1", []byte("s3cr3t")).JWK()
+	assert.Error(t, err)
+}
+
+// A key's alg must match its type, else a token could pick an algorithm the key was never meant for
+func TestJWKAlgMatchesKeyType(t *testing.T) {
+	rsaKey, _ := ParsePEM("rsa-1", rsaPEM(t))
+	rsaJWK, _ := rsaKey.JWK()
+	ecKey, _ := ParsePEM("ec-1", ecdsaPEM(t))
+	ecJWK, _ := ecKey.JWK()
+
+	tests := []struct {
+		name     string
+		jwk      JWK
+		alg      string
+		expected string
+	}{
+		{name: "RSA with RS384", jwk: rsaJWK, alg: "RS384", expected: "RS384"},
+		{name: "RSA with PS256", jwk: rsaJWK, alg: "PS256", expected: "PS256"},
+		{name: "RSA with ES256", jwk: rsaJWK, alg: "ES256"},
+		{name: "RSA with HS256", jwk: rsaJWK, alg: "HS256"},
+		{name: "EC with the alg of its curve", jwk: ecJWK, alg: "ES384", expected: "ES384"},
+		{name: "EC with another curve's alg", jwk: ecJWK, alg: "ES256"},
+		{name: "EC with RS256", jwk: ecJWK, alg: "RS256"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.jwk.Alg = tt.alg
+			key, err := tt.jwk.Key()
+			if tt.expected == "" {
+				assert.ErrorContains(t, err, "does not match")
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, key.Method.Alg())
+		})
+	}
+}
+
+// A key the package cannot use is skipped, the rest of the set stays usable
+func TestJWKSSkipsUnusableKeys(t *testing.T) {
+	key, _ := ParsePEM("rsa-1", rsaPEM(t))
+	set := marshalKeys(t, key)
+	set.Keys = append(set.Keys,
+		JWK{Kty: "oct", Kid: "hmac-1"},
+		JWK{Kty: "OKP", Kid: "ed-1", Crv: "Ed25519"},
+		JWK{Kty: "EC", Kid: "ec-1", Crv: "P-192"},
+	)
+	data, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, data, 0o600)
+
+	var logged []error
+	jwks, err := NewJWKS(path, WithErrorLog(func(err error) { logged = append(logged, err) }))
+	assert.NoError(t, err)
+	assert.Len(t, logged, 3)
+	token, _ := key.Sign(testClaims())
+	assert.NoError(t, parse(t, jwks, token))
+
+	// Without a usable key there is nothing to verify with
+	data, _ = json.Marshal(JWKSet{Keys: set.Keys[1:]})
+	os.WriteFile(path, data, 0o600)
+	err = jwks.Refresh()
+	assert.ErrorContains(t, err, "no usable signing keys")
+	assert.ErrorContains(t, err, "symmetric keys are not accepted")
+	assert.NoError(t, parse(t, jwks, token), "the last good set stays in use")
+}
+
+func TestJWKSScheduledRefresh(t *testing.T) {
+	oldKey, _ := ParsePEM("k1", rsaPEM(t))
+	newKey, _ := ParsePEM("k2", rsaPEM(t))
+	server := newJWKSServer(t, oldKey)
+
+	jwks, err := NewJWKS(server.URL, WithRefreshInterval(10*time.Millisecond), WithMinRefreshInterval(time.Hour))
+	assert.NoError(t, err)
+	jwks.Start()
+	defer jwks.Stop()
+
+	server.rotate(newKey)
+	assert.Eventually(t, func() bool {
+		_, ok := jwks.lookup("k2")
+		return ok
+	}, time.Second, 10*time.Millisecond)
+}
+
+// A key rotated in with another algorithm is accepted at once, and tokens
+// still cannot pick an algorithm their key was not made for
+func TestJWKSRotatesAlgorithm(t *testing.T) {
+	rsaKey, _ := ParsePEM("rsa-1", rsaPEM(t))
+	ecKey, _ := ParsePEM("ec-1", ecdsaPEM(t))
+	server := newJWKSServer(t, rsaKey)
+	jwks, err := NewJWKS(server.URL, WithMinRefreshInterval(0))
+	assert.NoError(t, err)
+
+	server.rotate(ecKey)
+	token, _ := ecKey.Sign(testClaims())
+	assert.NoError(t, Verify(token, &jwt.RegisteredClaims{}, jwks, ValidationOptions{}))
+
+	forged, _ := NewHMACKey("ec-1", []byte("guess")).Sign(testClaims())
+	err = Verify(forged, &jwt.RegisteredClaims{}, jwks, ValidationOptions{})
+	assert.Equal(t, CodeUnsupportedAlgorithm, ErrorCode(err))
+
+	err = Verify(token, &jwt.RegisteredClaims{}, jwks, ValidationOptions{Algorithms: []string{"RS256"}})
+	assert.Equal(t, CodeUnsupportedAlgorithm, ErrorCode(err), "JWT_ALGORITHMS still narrows the list")
+}
+
+func TestJWKSFromFile(t *testing.T) {
+	key, _ := ParsePEM("rsa-1", rsaPEM(t))
+	data, _ := json.Marshal(marshalKeys(t, key))
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	os.WriteFile(path, data, 0o600)
+
+	t.Setenv("JWT_JWKS_URL", path)
+	jwks, err := JWKSFromEnv()
+	assert.NoError(t, err)
+
+	token, _ := key.Sign(testClaims())
+	assert.NoError(t, parse(t, jwks, token))
+
+	t.Setenv("JWT_JWKS_REFRESH", "15m")
+	jwks, err = JWKSFromEnv()
+	assert.NoError(t, err)
+	assert.Equal(t, 15*time.Minute, jwks.refreshInterval)
+
+	// Start would panic on a ticker that never ticks
+	for _, refresh := range []string{"0", "-1m", "soon"} {
+		t.Setenv("JWT_JWKS_REFRESH", refresh)
+		_, err = JWKSFromEnv()
+		assert.ErrorContains(t, err, "JWT_JWKS_REFRESH", refresh)
+	}
+}
+
+func TestProviders(t *testing.T) {
+	local := NewKeySet(NewHMACKey("local", []byte("a")))
+	remote := NewKeySet(NewHMACKey("remote", []byte("b")))
+	providers := Providers{remote, local}
+
+	key, err := providers.Key("local")
+	assert.NoError(t, err)
+	assert.Equal(t, "local", key.ID)
+
+	_, err = providers.Key("missing")
+	assert.ErrorIs(t, err, ErrUnknownKey)
+}
@@ -0,0 +1,194 @@
+package authn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// ErrUnknownKey is returned when a token references a kid the provider does not know
+var ErrUnknownKey = errors.New("unknown signing key")
+
+// Key is a signing or verification key identified by its kid
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// Private signs tokens, it is nil for verification-only keys
+	Private interface{}
+	// Public verifies tokens, for HMAC keys it is the shared secret
+	Public interface{}
+}
+
+// NewHMACKey creates an HS256 key from a shared secret
+func NewHMACKey(kid string, secret []byte) *Key {
+	return &Key{ID: kid, Method: jwt.SigningMethodHS256, Private: secret, Public: secret}
+}
+
+// NewKey wraps an HMAC secret, or an RSA or ECDSA private or public key
+func NewKey(kid string, key interface{}) (*Key, error) {
+	switch k := key.(type) {
+	case []byte:
+		return NewHMACKey(kid, k), nil
+	case *rsa.PrivateKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodRS256, Private: k, Public: &k.PublicKey}, nil
+	case *rsa.PublicKey:
+		return &Key{ID: kid, Method: jwt.SigningMethodRS256, Public: k}, nil
+	case *ecdsa.PrivateKey:
+		method, err := ecdsaMethod(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{ID: kid, Method: method, Private: k, Public: &k.PublicKey}, nil
+	case *ecdsa.PublicKey:
+		method, err := ecdsaMethod(k.Curve)
+		if err != nil {
+			return nil, err
+		}
+		return &Key{ID: kid, Method: method, Public: k}, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+func ecdsaMethod(curve elliptic.Curve) (jwt.SigningMethod, error) {
+	switch curve {
+	case elliptic.P256():
+		return jwt.SigningMethodES256, nil
+	case elliptic.P384():
+		return jwt.SigningMethodES384, nil
+	case elliptic.P521():
+		return jwt.SigningMethodES512, nil
+	default:
+		return nil, fmt.Errorf("unsupported ECDSA curve %s", curve.Params().Name)
+	}
+}
+
+// ParsePEM reads an RSA or ECDSA key, private or public, from PEM data
+func ParsePEM(kid string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PUBLIC KEY":
+		key, err = x509.ParsePKCS1PublicKey(block.Bytes)
+	case "PUBLIC KEY":
+		key, err = x509.ParsePKIXPublicKey(block.Bytes)
+	case "CERTIFICATE":
+		var cert *x509.Certificate
+		cert, err = x509.ParseCertificate(block.Bytes)
+		if err == nil {
+			key = cert.PublicKey
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewKey(kid, key)
+}
+
+// Sign signs the claims with the key and sets the kid header
+func (k *Key) Sign(claims jwt.Claims) (string, error) {
+	if k.Private == nil {
+		return "", fmt.Errorf("key %q cannot sign tokens", k.ID)
+	}
+	token := jwt.NewWithClaims(k.Method, claims)
+	if k.ID != "" {
+		token.Header["kid"] = k.ID
+	}
+	return token.SignedString(k.Private)
+}
+
+// KeyProvider resolves the key used to verify a token
+type KeyProvider interface {
+	// Key returns the key for a kid, an empty kid selects the default key
+	Key(kid string) (*Key, error)
+}
+
+// Keyfunc adapts a KeyProvider to jwt.Keyfunc. The token's kid header picks
+// the key and the token must be signed with that key's algorithm.
+func Keyfunc(p KeyProvider) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := p.Key(kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, fmt.Errorf("unexpected signing method %s for key %q", token.Method.Alg(), kid)
+		}
+		return key.Public, nil
+	}
+}
+
+// KeySet holds several keys at once, so tokens signed by a retired key keep
+// verifying while new tokens are signed by the active key
+type KeySet struct {
+	mu     sync.RWMutex
+	keys   map[string]*Key
+	active *Key
+}
+
+// NewKeySet creates a key set signing with active and verifying with every key
+func NewKeySet(active *Key, keys ...*Key) *KeySet {
+	s := &KeySet{keys: map[string]*Key{}}
+	for _, k := range keys {
+		s.Add(k)
+	}
+	s.SetActive(active)
+	return s
+}
+
+// Add registers a verification key
+func (s *KeySet) Add(k *Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+}
+
+// SetActive registers k and makes it the key used to sign new tokens
+func (s *KeySet) SetActive(k *Key) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[k.ID] = k
+	s.active = k
+}
+
+// Active returns the signing key
+func (s *KeySet) Active() *Key {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.active
+}
+
+// Key implements KeyProvider
+func (s *KeySet) Key(kid string) (*Key, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if kid == "" && s.active != nil {
+		return s.active, nil
+	}
+	key, ok := s.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", ErrUnknownKey, kid)
+	}
+	return key, nil
+}
@@ -0,0 +1,191 @@
+package authn
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func testClaims() jwt.RegisteredClaims {
+	return jwt.RegisteredClaims{Subject: "user1", ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))}
+}
+
+func parse(t *testing.T, p KeyProvider, tokenString string) error {
+	t.Helper()
+	_, err := jwt.ParseWithClaims(tokenString, &jwt.RegisteredClaims{}, Keyfunc(p))
+	return err
+}
+
+func rsaPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
+
+func ecdsaPEM(t *testing.T) []byte {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	assert.NoError(t, err)
+	der, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+}
+
+func TestSignAndVerify(t *testing.T) {
+	rsaKey, err := ParsePEM("rsa-1", rsaPEM(t))
+	assert.NoError(t, err)
+	ecKey, err := ParsePEM("ec-1", ecdsaPEM(t))
+	assert.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		key    *Key
+		method string
+	}{
+		{name: "HMAC", key: NewHMACKey("hmac-1", []byte("s3cr3t")), method: "HS256"},
+		{name: "RSA", key: rsaKey, method: "RS256"},
+		{name: "ECDSA", key: ecKey, method: "ES384"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.method, tt.key.Method.Alg())
+
+			token, err := tt.key.Sign(testClaims())
+			assert.NoError(t, err)
+			assert.NoError(t, parse(t, NewKeySet(tt.key), token))
+		})
+	}
+}
+
+func TestKeySetSelectsKeyByKid(t *testing.T) {
+	oldKey := NewHMACKey("old", []byte("old-secret"))
+	newKey := NewHMACKey("new", []byte("new-secret"))
+	set := NewKeySet(newKey, oldKey)
+
+	oldToken, _ := oldKey.Sign(testClaims())
+	newToken, _ := set.Active().Sign(testClaims())
+	assert.NoError(t, parse(t, set, oldToken))
+	assert.NoError(t, parse(t, set, newToken))
+
+	unknown, _ := NewHMACKey("other", []byte("old-secret")).Sign(testClaims())
+	assert.ErrorContains(t, parse(t, set, unknown), "unknown signing key")
+}
+
+func TestKeyfuncRejectsAlgorithmMismatch(t *testing.T) {
+	rsaKey, err := ParsePEM("k1", rsaPEM(t))
+	assert.NoError(t, err)
+
+	// An HMAC token signed with the RSA public key bytes must not verify
+	der := x509.MarshalPKCS1PublicKey(rsaKey.Public.(*rsa.PublicKey))
+	forged, _ := NewHMACKey("k1", der).Sign(testClaims())
+
+	assert.ErrorContains(t, parse(t, NewKeySet(rsaKey), forged), "unexpected signing method")
+}
+
+func TestPublicKeyCannotSign(t *testing.T) {
+	rsaKey, _ := ParsePEM("k1", rsaPEM(t))
+	der, _ := x509.MarshalPKIXPublicKey(rsaKey.Public)
+	public, err := ParsePEM("k1", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}))
+	assert.NoError(t, err)
+
+	_, err = public.Sign(testClaims())
+	assert.Error(t, err)
+
+	token, _ := rsaKey.Sign(testClaims())
+	assert.NoError(t, parse(t, NewKeySet(public), token))
+}
+
+func TestKeySetFromEnv(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret")
+	os.WriteFile(secretFile, []byte("file-secret\n"), 0o600)
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(keyFile, ecdsaPEM(t), 0o600)
+
+	t.Run("nothing configured", func(t *testing.T) {
+		_, err := KeySetFromEnv()
+		assert.ErrorIs(t, err, ErrNoKeys)
+	})
+
+	t.Run("secret file", func(t *testing.T) {
+		t.Setenv("JWT_KEY_ID", "k1")
+		t.Setenv("JWT_SECRET_FILE", secretFile)
+
+		set, err := KeySetFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("file-secret"), set.Active().Public)
+		assert.Equal(t, "k1", set.Active().ID)
+	})
+
+	t.Run("private key with extra verification keys", func(t *testing.T) {
+		t.Setenv("JWT_PRIVATE_KEY_FILE", keyFile)
+		t.Setenv("JWT_VERIFY_KEYS", "old="+keyFile)
+
+		set, err := KeySetFromEnv()
+		assert.NoError(t, err)
+		assert.Equal(t, "ES384", set.Active().Method.Alg())
+		_, err = set.Key("old")
+		assert.NoError(t, err)
+	})
+
+	t.Run("retired secret next to a new one", func(t *testing.T) {
+		t.Setenv("JWT_KEY_ID", "new")
+		t.Setenv("JWT_SECRET", "new-secret")
+		t.Setenv("JWT_VERIFY_SECRET_FILES", "old="+secretFile)
+
+		set, err := KeySetFromEnv()
+		assert.NoError(t, err)
+		old, err := set.Key("old")
+		assert.NoError(t, err)
+		assert.Equal(t, []byte("file-secret"), old.Public)
+		assert.Equal(t, "HS256", old.Method.Alg())
+
+		token, _ := old.Sign(testClaims())
+		assert.NoError(t, parse(t, set, token), "tokens of the retired secret stay valid")
+		assert.Equal(t, "new", set.Active().ID, "new tokens are signed with the new secret")
+	})
+
+	t.Run("malformed verification secret", func(t *testing.T) {
+		t.Setenv("JWT_SECRET", "a")
+		t.Setenv("JWT_VERIFY_SECRET_FILES", secretFile)
+
+		_, err := KeySetFromEnv()
+		assert.ErrorContains(t, err, "JWT_VERIFY_SECRET_FILES")
+	})
+
+	t.Run("conflicting sources", func(t *testing.T) {
+		t.Setenv("JWT_SECRET", "a")
+		t.Setenv("JWT_SECRET_FILE", secretFile)
+
+		_, err := KeySetFromEnv()
+		assert.Error(t, err)
+	})
+}
+
+// singleKey is a KeyProvider that cannot list its keys
+func TestDevModeFromEnv(t *testing.T) {
+	devMode, err := DevModeFromEnv()
+	assert.NoError(t, err)
+	assert.False(t, devMode, "the development secret needs an explicit opt-in")
+
+	t.Setenv("DEV_TOKEN_ENDPOINT", "true")
+	devMode, err = DevModeFromEnv()
+	assert.NoError(t, err)
+	assert.True(t, devMode)
+
+	t.Setenv("DEV_TOKEN_ENDPOINT", "sure")
+	_, err = DevModeFromEnv()
+	assert.Error(t, err)
+}
@@ -0,0 +1,181 @@
+package authn
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrInvalidRefreshToken is returned for unknown, expired or revoked refresh tokens
+var ErrInvalidRefreshToken = errors.New("invalid refresh token")
+
+// ReuseError is returned when a refresh token that was already rotated is
+// presented again. The whole family is revoked, the caller should also revoke
+// the access tokens it lists.
+type ReuseError struct {
+	Family string
+	// AccessTokens maps the jti of every access token issued in the family to its expiry
+	AccessTokens map[string]time.Time
+}
+
+func (e *ReuseError) Error() string {
+	return "refresh token reused"
+}
+
+// Grant is what a refresh token stands for, the identity and permissions
+// access tokens are derived from on every refresh
+type Grant struct {
+	Subject string
+	Roles   []string
+	Scopes  []string
+}
+
+// RefreshToken is a newly issued refresh token
+type RefreshToken struct {
+	Token     string
+	Family    string
+	Grant     Grant
+	ExpiresAt time.Time
+}
+
+type refreshEntry struct {
+	family    string
+	expiresAt time.Time
+	used      bool
+}
+
+type refreshFamily struct {
+	grant        Grant
+	revoked      bool
+	accessTokens map[string]time.Time
+}
+
+// RefreshStore issues rotating refresh tokens. Every refresh token belongs to
+// a family started by Issue; Rotate trades a token for the next one in its
+// family and detects reuse of a token that was already traded.
+type RefreshStore struct {
+	ttl time.Duration
+	now func() time.Time
+
+	mu       sync.Mutex
+	tokens   map[string]*refreshEntry
+	families map[string]*refreshFamily
+}
+
+// NewRefreshStore creates an in-memory store whose tokens live for ttl
+func NewRefreshStore(ttl time.Duration) *RefreshStore {
+	return &RefreshStore{
+		ttl:      ttl,
+		now:      time.Now,
+		tokens:   map[string]*refreshEntry{},
+		families: map[string]*refreshFamily{},
+	}
+}
+
+// Issue starts a new family for grant and returns its first refresh token
+func (s *RefreshStore) Issue(grant Grant) (*RefreshToken, error) {
+	family, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.prune()
+	s.families[family] = &refreshFamily{grant: grant, accessTokens: map[string]time.Time{}}
+	return s.next(family)
+}
+
+// Rotate trades a refresh token for the next one in its family
+func (s *RefreshStore) Rotate(token string) (*RefreshToken, error) {
+	return s.RotateIf(token, nil)
+}
+
+// RotateIf is Rotate, unless accept rejects the grant of the token. Its error
+// is returned and the token stays valid, so a client can retry with a request
+// accept takes without tripping reuse detection. A reused token is still
+// detected first.
+func (s *RefreshStore) RotateIf(token string, accept func(grant Grant) error) (*RefreshToken, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.tokens[hashToken(token)]
+	if !ok || s.families[entry.family].revoked || s.now().After(entry.expiresAt) {
+		return nil, ErrInvalidRefreshToken
+	}
+
+	family := s.families[entry.family]
+	if entry.used {
+		// Someone holds a copy of the token, so no token of the family can be trusted
+		family.revoked = true
+		accessTokens := map[string]time.Time{}
+		for jti, exp := range family.accessTokens {
+			accessTokens[jti] = exp
+		}
+		return nil, &ReuseError{Family: entry.family, AccessTokens: accessTokens}
+	}
+
+	if accept != nil {
+		if err := accept(family.grant); err != nil {
+			return nil, err
+		}
+	}
+	entry.used = true
+	return s.next(entry.family)
+}
+
+// TrackAccessToken records an access token issued in a family, so it is
+// reported by a ReuseError if the family gets compromised
+func (s *RefreshStore) TrackAccessToken(family, jti string, expiresAt time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if f, ok := s.families[family]; ok {
+		f.accessTokens[jti] = expiresAt
+	}
+}
+
+func (s *RefreshStore) next(family string) (*RefreshToken, error) {
+	token, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	expiresAt := s.now().Add(s.ttl)
+	s.tokens[hashToken(token)] = &refreshEntry{family: family, expiresAt: expiresAt}
+	return &RefreshToken{Token: token, Family: family, Grant: s.families[family].grant, ExpiresAt: expiresAt}, nil
+}
+
+// prune forgets expired tokens and families left without any token
+func (s *RefreshStore) prune() {
+	now := s.now()
+	live := map[string]bool{}
+	for hash, entry := range s.tokens {
+		if now.After(entry.expiresAt) {
+			delete(s.tokens, hash)
+			continue
+		}
+		live[entry.family] = true
+	}
+	for family := range s.families {
+		if !live[family] {
+			delete(s.families, family)
+		}
+	}
+}
+
+// hashToken keeps raw refresh tokens out of memory dumps
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
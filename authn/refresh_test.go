@@ -0,0 +1,92 @@
+package authn
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRefreshStoreRotation(t *testing.T) {
+	store := NewRefreshStore(time.Hour)
+	grant := Grant{Subject: "user1", Roles: []string{"user"}, Scopes: []string{"user:read:self"}}
+
+	first, err := store.Issue(grant)
+	assert.NoError(t, err)
+
+	second, err := store.Rotate(first.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Family, second.Family)
+	assert.Equal(t, grant, second.Grant)
+	assert.NotEqual(t, first.Token, second.Token)
+
+	third, err := store.Rotate(second.Token)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Family, third.Family)
+}
+
+func TestRefreshStoreReuseRevokesFamily(t *testing.T) {
+	store := NewRefreshStore(time.Hour)
+	first, _ := store.Issue(Grant{Subject: "user1"})
+	store.TrackAccessToken(first.Family, "jti-1", time.Now().Add(time.Minute))
+
+	second, _ := store.Rotate(first.Token)
+	store.TrackAccessToken(second.Family, "jti-2", time.Now().Add(time.Minute))
+
+	// The stolen first token is replayed
+	_, err := store.Rotate(first.Token)
+	var reuse *ReuseError
+	assert.True(t, errors.As(err, &reuse))
+	assert.Equal(t, first.Family, reuse.Family)
+	assert.Len(t, reuse.AccessTokens, 2)
+
+	// The legitimate holder's latest token is dead too
+	_, err = store.Rotate(second.Token)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// Other families are not affected
+	other, _ := store.Issue(Grant{Subject: "user2"})
+	_, err = store.Rotate(other.Token)
+	assert.NoError(t, err)
+}
+
+func TestRefreshStoreRejectsUnknownAndExpiredTokens(t *testing.T) {
+	store := NewRefreshStore(time.Hour)
+	now := time.Now()
+	store.now = func() time.Time { return now }
+
+	_, err := store.Rotate("made-up")
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	token, _ := store.Issue(Grant{Subject: "user1"})
+	now = now.Add(2 * time.Hour)
+	_, err = store.Rotate(token.Token)
+	assert.ErrorIs(t, err, ErrInvalidRefreshToken)
+
+	// Issuing prunes the expired family
+	store.Issue(Grant{Subject: "user2"})
+	assert.Len(t, store.families, 1)
+}
+
+// A grant accept rejects leaves the token unspent, a reused token is reported before accept runs
+func TestRefreshStoreRotateIf(t *testing.T) {
+	store := NewRefreshStore(time.Hour)
+	first, _ := store.Issue(Grant{Subject: "user1"})
+	errRejected := errors.New("rejected")
+	reject := func(Grant) error { return errRejected }
+
+	_, err := store.RotateIf(first.Token, reject)
+	assert.ErrorIs(t, err, errRejected)
+
+	second, err := store.RotateIf(first.Token, func(grant Grant) error {
+		assert.Equal(t, "user1", grant.Subject)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, first.Family, second.Family)
+
+	_, err = store.RotateIf(first.Token, reject)
+	var reuse *ReuseError
+	assert.ErrorAs(t, err, &reuse)
+}
@@ -0,0 +1,203 @@
+package authn
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/internal/atomicfile"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// CodeTokenRevoked is reported for tokens found in a RevocationStore
+const CodeTokenRevoked = "token_revoked"
+
+// RevocationStore records tokens that must be rejected before they expire
+type RevocationStore interface {
+	// RevokeToken revokes the token with the given jti, the entry can be
+	// forgotten once the token has expired. A zero expiresAt, for a token
+	// whose expiry is not known, is kept for good.
+	RevokeToken(jti string, expiresAt time.Time) error
+	// RevokeSubject revokes every token of subject issued before the given time
+	RevokeSubject(subject string, before time.Time) error
+	// IsRevoked reports whether a token has been revoked
+	IsRevoked(jti, subject string, issuedAt time.Time) (bool, error)
+}
+
+// CheckRevoked returns a ValidationError when the token was revoked. Tokens
+// without iat count as issued before any subject revocation.
+func CheckRevoked(store RevocationStore, claims *jwt.RegisteredClaims) error {
+	var issuedAt time.Time
+	if claims.IssuedAt != nil {
+		issuedAt = claims.IssuedAt.Time
+	}
+	revoked, err := store.IsRevoked(claims.ID, claims.Subject, issuedAt)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return validationError(CodeTokenRevoked, "token has been revoked")
+	}
+	return nil
+}
+
+type revocations struct {
+	Tokens   map[string]time.Time `json:"tokens"`
+	Subjects map[string]time.Time `json:"subjects"`
+}
+
+// MemoryRevocationStore keeps revocations in memory
+type MemoryRevocationStore struct {
+	mu   sync.RWMutex
+	data revocations
+	now  func() time.Time
+}
+
+// NewMemoryRevocationStore creates an empty in-memory store
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		data: revocations{Tokens: map[string]time.Time{}, Subjects: map[string]time.Time{}},
+		now:  time.Now,
+	}
+}
+
+// RevokeToken implements RevocationStore
+func (s *MemoryRevocationStore) RevokeToken(jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revokeToken(jti, expiresAt)
+}
+
+// revokeToken records a revoked token, the caller holds the write lock
+func (s *MemoryRevocationStore) revokeToken(jti string, expiresAt time.Time) error {
+	if jti == "" {
+		return errors.New("jti is required")
+	}
+
+	// Expired tokens are rejected anyway, there is no need to remember them
+	now := s.now()
+	for id, exp := range s.data.Tokens {
+		if !exp.IsZero() && exp.Before(now) {
+			delete(s.data.Tokens, id)
+		}
+	}
+	s.data.Tokens[jti] = expiresAt
+	return nil
+}
+
+// RevokeSubject implements RevocationStore
+func (s *MemoryRevocationStore) RevokeSubject(subject string, before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.revokeSubject(subject, before)
+}
+
+// revokeSubject records a revoked subject, the caller holds the write lock
+func (s *MemoryRevocationStore) revokeSubject(subject string, before time.Time) error {
+	if subject == "" {
+		return errors.New("subject is required")
+	}
+	if before.After(s.data.Subjects[subject]) {
+		s.data.Subjects[subject] = before
+	}
+	return nil
+}
+
+// IsRevoked implements RevocationStore
+func (s *MemoryRevocationStore) IsRevoked(jti, subject string, issuedAt time.Time) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.data.Tokens[jti]; ok && jti != "" {
+		return true, nil
+	}
+	if before, ok := s.data.Subjects[subject]; ok && subject != "" && issuedAt.Before(before) {
+		return true, nil
+	}
+	return false, nil
+}
+
+// FileRevocationStore keeps revocations in memory and writes them to a JSON
+// file on every change, so they survive restarts
+type FileRevocationStore struct {
+	*MemoryRevocationStore
+	path string
+}
+
+// NewFileRevocationStore loads the revocations saved at path, a missing file is an empty store
+func NewFileRevocationStore(path string) (*FileRevocationStore, error) {
+	s := &FileRevocationStore{MemoryRevocationStore: NewMemoryRevocationStore(), path: path}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.data); err != nil {
+		return nil, err
+	}
+	if s.data.Tokens == nil {
+		s.data.Tokens = map[string]time.Time{}
+	}
+	if s.data.Subjects == nil {
+		s.data.Subjects = map[string]time.Time{}
+	}
+	return s, nil
+}
+
+// RevokeToken implements RevocationStore. Expired tokens pruned on the way
+// stay pruned when the save fails, they are rejected anyway.
+func (s *FileRevocationStore) RevokeToken(jti string, expiresAt time.Time) error {
+	return s.change(func() (func(), error) {
+		return restore(s.data.Tokens, jti), s.revokeToken(jti, expiresAt)
+	})
+}
+
+// RevokeSubject implements RevocationStore
+func (s *FileRevocationStore) RevokeSubject(subject string, before time.Time) error {
+	return s.change(func() (func(), error) {
+		return restore(s.data.Subjects, subject), s.revokeSubject(subject, before)
+	})
+}
+
+// change applies a change and saves it while holding the write lock, so
+// writes reach the file in order. apply returns the inverse of its change,
+// which is run when the change cannot be saved.
+func (s *FileRevocationStore) change(apply func() (undo func(), err error)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	undo, err := apply()
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		undo()
+		return err
+	}
+	return nil
+}
+
+// restore returns a func putting key in m back the way it is now
+func restore(m map[string]time.Time, key string) func() {
+	previous, ok := m[key]
+	return func() {
+		if ok {
+			m[key] = previous
+		} else {
+			delete(m, key)
+		}
+	}
+}
+
+// save writes the revocations, the caller holds the lock
+func (s *FileRevocationStore) save() error {
+	data, err := json.MarshalIndent(s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(s.path, data)
+}
@@ -0,0 +1,126 @@
+package authn
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryRevocationStore(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	now := time.Now()
+
+	assert.NoError(t, store.RevokeToken("jti-1", now.Add(time.Hour)))
+	assert.NoError(t, store.RevokeSubject("user2", now))
+
+	tests := []struct {
+		name     string
+		jti      string
+		subject  string
+		issuedAt time.Time
+		revoked  bool
+	}{
+		{name: "revoked jti", jti: "jti-1", subject: "user1", issuedAt: now, revoked: true},
+		{name: "other jti", jti: "jti-2", subject: "user1", issuedAt: now},
+		{name: "subject token issued before revocation", jti: "jti-3", subject: "user2", issuedAt: now.Add(-time.Minute), revoked: true},
+		{name: "subject token issued after revocation", jti: "jti-4", subject: "user2", issuedAt: now.Add(time.Minute)},
+		{name: "subject token without iat", jti: "jti-5", subject: "user2", revoked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			revoked, err := store.IsRevoked(tt.jti, tt.subject, tt.issuedAt)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.revoked, revoked)
+		})
+	}
+
+	assert.Error(t, store.RevokeToken("", now))
+	assert.Error(t, store.RevokeSubject("", now))
+}
+
+func TestMemoryRevocationStoreForgetsExpiredTokens(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	store.RevokeToken("old", time.Now().Add(-time.Minute))
+	store.RevokeToken("new", time.Now().Add(time.Hour))
+
+	assert.NotContains(t, store.data.Tokens, "old")
+	assert.Contains(t, store.data.Tokens, "new")
+}
+
+// A jti whose expiry is not known is never forgotten, however many revocations follow
+func TestMemoryRevocationStoreKeepsTokensWithoutExpiry(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	start := time.Now()
+	store.now = func() time.Time { return start }
+	assert.NoError(t, store.RevokeToken("one-hour", time.Time{}))
+
+	store.now = func() time.Time { return start.Add(16 * time.Minute) }
+	assert.NoError(t, store.RevokeToken("other", start.Add(31*time.Minute)))
+
+	revoked, err := store.IsRevoked("one-hour", "user1", start)
+	assert.NoError(t, err)
+	assert.True(t, revoked)
+}
+
+func TestFileRevocationStoreSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	now := time.Now()
+
+	store, err := NewFileRevocationStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.RevokeToken("jti-1", now.Add(time.Hour)))
+	assert.NoError(t, store.RevokeSubject("user2", now))
+
+	reopened, err := NewFileRevocationStore(path)
+	assert.NoError(t, err)
+
+	revoked, _ := reopened.IsRevoked("jti-1", "user1", now)
+	assert.True(t, revoked)
+	revoked, _ = reopened.IsRevoked("jti-2", "user2", now.Add(-time.Second))
+	assert.True(t, revoked)
+}
+
+// A revocation that cannot be saved is not kept, and concurrent ones all reach the file
+func TestFileRevocationStoreWrites(t *testing.T) {
+	broken, err := NewFileRevocationStore(filepath.Join(t.TempDir(), "missing", "revocations.json"))
+	assert.NoError(t, err)
+	assert.Error(t, broken.RevokeToken("jti-1", time.Now().Add(time.Hour)))
+	assert.Error(t, broken.RevokeSubject("user1", time.Now()))
+	revoked, _ := broken.IsRevoked("jti-1", "user1", time.Now().Add(-time.Minute))
+	assert.False(t, revoked)
+
+	path := filepath.Join(t.TempDir(), "revocations.json")
+	store, err := NewFileRevocationStore(path)
+	assert.NoError(t, err)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.RevokeToken(fmt.Sprintf("jti-%d", i), time.Now().Add(time.Hour)))
+		}()
+	}
+	wg.Wait()
+
+	reopened, err := NewFileRevocationStore(path)
+	assert.NoError(t, err)
+	for i := 0; i < 20; i++ {
+		revoked, _ := reopened.IsRevoked(fmt.Sprintf("jti-%d", i), "", time.Now())
+		assert.True(t, revoked, "jti-%d", i)
+	}
+}
+
+func TestCheckRevoked(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	store.RevokeToken("jti-1", time.Now().Add(time.Hour))
+
+	err := CheckRevoked(store, &jwt.RegisteredClaims{ID: "jti-1"})
+	assert.Equal(t, CodeTokenRevoked, ErrorCode(err))
+	assert.NoError(t, CheckRevoked(store, &jwt.RegisteredClaims{ID: "jti-2"}))
+}
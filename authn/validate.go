@@ -0,0 +1,218 @@
+package authn
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Error codes reported by Verify
+const (
+	CodeTokenMissing         = "token_missing"
+	CodeTokenMalformed       = "token_malformed"
+	CodeUnsupportedAlgorithm = "unsupported_algorithm"
+	CodeUnknownKey           = "unknown_key"
+	CodeInvalidSignature     = "invalid_signature"
+	CodeTokenExpired         = "token_expired"
+	CodeTokenNotYetValid     = "token_not_yet_valid"
+	CodeTokenTooOld          = "token_too_old"
+	CodeInvalidIssuer        = "invalid_issuer"
+	CodeInvalidAudience      = "invalid_audience"
+	CodeInvalidToken         = "invalid_token"
+)
+
+// ValidationError explains why a token was rejected
+type ValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+func validationError(code, format string, args ...interface{}) *ValidationError {
+	return &ValidationError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ErrorCode returns the code of a ValidationError, or CodeInvalidToken for any other error
+func ErrorCode(err error) string {
+	var ve *ValidationError
+	if errors.As(err, &ve) {
+		return ve.Code
+	}
+	return CodeInvalidToken
+}
+
+// ValidationOptions restrict which tokens Verify accepts. Empty fields are not enforced.
+type ValidationOptions struct {
+	// Algorithms lists the accepted alg header values. Whatever it says, a
+	// token must use the algorithm of the key that verifies it, see Keyfunc,
+	// so empty accepts the algorithms of the keys as they are now.
+	Algorithms []string
+	// Issuers lists the accepted iss values
+	Issuers []string
+	// Audiences lists the audiences of this service, the token's aud must contain one of them
+	Audiences []string
+	// Leeway tolerates clock skew when checking exp, nbf and iat
+	Leeway time.Duration
+	// MaxAge rejects tokens issued longer ago than this, it requires iat
+	MaxAge time.Duration
+}
+
+// ValidationOptionsFromEnv overrides defaults with the environment:
+//
+//	JWT_ALGORITHMS  comma separated alg allow-list, e.g. HS256,RS256
+//	JWT_ISSUERS     comma separated accepted issuers
+//	JWT_AUDIENCES   comma separated audiences of this service
+//	JWT_LEEWAY      clock skew leeway, e.g. 30s
+//	JWT_MAX_AGE     maximum token age, e.g. 24h
+func ValidationOptionsFromEnv(defaults ValidationOptions) (ValidationOptions, error) {
+	opts := defaults
+	for name, field := range map[string]*[]string{
+		"JWT_ALGORITHMS": &opts.Algorithms,
+		"JWT_ISSUERS":    &opts.Issuers,
+		"JWT_AUDIENCES":  &opts.Audiences,
+	} {
+		if value := os.Getenv(name); value != "" {
+			*field = splitList(value)
+		}
+	}
+	for name, field := range map[string]*time.Duration{
+		"JWT_LEEWAY":  &opts.Leeway,
+		"JWT_MAX_AGE": &opts.MaxAge,
+	} {
+		if value := os.Getenv(name); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return opts, fmt.Errorf("%s: %w", name, err)
+			}
+			*field = d
+		}
+	}
+	return opts, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Verify parses tokenString into claims, verifies its signature with a key
+// from keys and enforces opts. Failures are returned as *ValidationError.
+func Verify(tokenString string, claims jwt.Claims, keys KeyProvider, opts ValidationOptions) error {
+	if tokenString == "" {
+		return validationError(CodeTokenMissing, "token missing")
+	}
+
+	keyfunc := Keyfunc(keys)
+	parser := jwt.NewParser(jwt.WithoutClaimsValidation())
+	_, err := parser.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		alg := token.Method.Alg()
+		if len(opts.Algorithms) > 0 && !contains(opts.Algorithms, alg) {
+			return nil, validationError(CodeUnsupportedAlgorithm, "signing algorithm %s is not allowed", alg)
+		}
+		key, err := keyfunc(token)
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, validationError(CodeUnknownKey, "%s", err)
+		}
+		if err != nil {
+			return nil, validationError(CodeUnsupportedAlgorithm, "%s", err)
+		}
+		return key, nil
+	})
+	var ve *ValidationError
+	switch {
+	case err == nil:
+		return validate(claims, opts, time.Now())
+	case errors.As(err, &ve):
+		return ve
+	case errors.Is(err, jwt.ErrTokenMalformed):
+		return validationError(CodeTokenMalformed, "token is malformed")
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid):
+		return validationError(CodeInvalidSignature, "token signature is invalid")
+	default:
+		return validationError(CodeInvalidToken, "invalid token")
+	}
+}
+
+func validate(claims jwt.Claims, opts ValidationOptions, now time.Time) error {
+	exp, err := claims.GetExpirationTime()
+	if err != nil {
+		return validationError(CodeTokenMalformed, "invalid exp claim")
+	}
+	nbf, err := claims.GetNotBefore()
+	if err != nil {
+		return validationError(CodeTokenMalformed, "invalid nbf claim")
+	}
+	iat, err := claims.GetIssuedAt()
+	if err != nil {
+		return validationError(CodeTokenMalformed, "invalid iat claim")
+	}
+	iss, err := claims.GetIssuer()
+	if err != nil {
+		return validationError(CodeTokenMalformed, "invalid iss claim")
+	}
+	aud, err := claims.GetAudience()
+	if err != nil {
+		return validationError(CodeTokenMalformed, "invalid aud claim")
+	}
+
+	if exp != nil && now.After(exp.Add(opts.Leeway)) {
+		return validationError(CodeTokenExpired, "token is expired")
+	}
+	if nbf != nil && now.Add(opts.Leeway).Before(nbf.Time) {
+		return validationError(CodeTokenNotYetValid, "token is not valid yet")
+	}
+	if iat != nil && now.Add(opts.Leeway).Before(iat.Time) {
+		return validationError(CodeTokenNotYetValid, "token is issued in the future")
+	}
+	if opts.MaxAge > 0 {
+		if iat == nil {
+			return validationError(CodeTokenTooOld, "token has no issued at time")
+		}
+		if now.Sub(iat.Time) > opts.MaxAge+opts.Leeway {
+			return validationError(CodeTokenTooOld, "token is older than %s", opts.MaxAge)
+		}
+	}
+	return checkIssuerAndAudience(iss, aud, opts)
+}
+
+// checkIssuerAndAudience enforces opts.Issuers and opts.Audiences, for JWTs
+// and introspected tokens alike
+func checkIssuerAndAudience(iss string, aud []string, opts ValidationOptions) error {
+	if len(opts.Issuers) > 0 && !contains(opts.Issuers, iss) {
+		return validationError(CodeInvalidIssuer, "issuer %q is not accepted", iss)
+	}
+	if len(opts.Audiences) > 0 {
+		accepted := false
+		for _, a := range aud {
+			if contains(opts.Audiences, a) {
+				accepted = true
+				break
+			}
+		}
+		if !accepted {
+			return validationError(CodeInvalidAudience, "token is not intended for this audience")
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+package authn
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerify(t *testing.T) {
+	key := NewHMACKey("k1", []byte("s3cr3t"))
+	keys := NewKeySet(key)
+	now := time.Now()
+
+	sign := func(claims jwt.Claims) string {
+		token, _ := key.Sign(claims)
+		return token
+	}
+
+	strict := ValidationOptions{
+		Algorithms: []string{"HS256"},
+		Issuers:    []string{"keycloak"},
+		Audiences:  []string{"accounts-api"},
+		Leeway:     time.Minute,
+		MaxAge:     time.Hour,
+	}
+	valid := jwt.RegisteredClaims{
+		Issuer:    "keycloak",
+		Audience:  jwt.ClaimStrings{"accounts-api"},
+		IssuedAt:  jwt.NewNumericDate(now),
+		ExpiresAt: jwt.NewNumericDate(now.Add(time.Hour)),
+	}
+	with := func(change func(c *jwt.RegisteredClaims)) jwt.RegisteredClaims {
+		c := valid
+		change(&c)
+		return c
+	}
+
+	hs512 := jwt.NewWithClaims(jwt.SigningMethodHS512, valid)
+	hs512.Header["kid"] = "k1"
+	hs512Token, _ := hs512.SignedString([]byte("s3cr3t"))
+
+	tests := []struct {
+		name         string
+		token        string
+		opts         ValidationOptions
+		expectedCode string
+	}{
+		{name: "valid token", token: sign(valid), opts: strict},
+		{name: "multi-valued audience", token: sign(with(func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"other", "accounts-api"} })), opts: strict},
+		{name: "expiry within leeway", token: sign(with(func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-30 * time.Second)) })), opts: strict},
+		{name: "missing token", token: "", opts: strict, expectedCode: CodeTokenMissing},
+		{name: "malformed token", token: "not-a-jwt", opts: strict, expectedCode: CodeTokenMalformed},
+		{name: "algorithm not allowed", token: hs512Token, opts: strict, expectedCode: CodeUnsupportedAlgorithm},
+		{name: "unknown kid", token: func() string { t, _ := NewHMACKey("k2", []byte("s3cr3t")).Sign(valid); return t }(), opts: strict, expectedCode: CodeUnknownKey},
+		{name: "bad signature", token: func() string { t, _ := NewHMACKey("k1", []byte("other")).Sign(valid); return t }(), opts: strict, expectedCode: CodeInvalidSignature},
+		{name: "expired", token: sign(with(func(c *jwt.RegisteredClaims) { c.ExpiresAt = jwt.NewNumericDate(now.Add(-2 * time.Minute)) })), opts: strict, expectedCode: CodeTokenExpired},
+		{name: "not yet valid", token: sign(with(func(c *jwt.RegisteredClaims) { c.NotBefore = jwt.NewNumericDate(now.Add(5 * time.Minute)) })), opts: strict, expectedCode: CodeTokenNotYetValid},
+		{name: "issued in the future", token: sign(with(func(c *jwt.RegisteredClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(5 * time.Minute)) })), opts: strict, expectedCode: CodeTokenNotYetValid},
+		{name: "too old", token: sign(with(func(c *jwt.RegisteredClaims) { c.IssuedAt = jwt.NewNumericDate(now.Add(-2 * time.Hour)) })), opts: strict, expectedCode: CodeTokenTooOld},
+		{name: "missing iat with max age", token: sign(with(func(c *jwt.RegisteredClaims) { c.IssuedAt = nil })), opts: strict, expectedCode: CodeTokenTooOld},
+		{name: "wrong issuer", token: sign(with(func(c *jwt.RegisteredClaims) { c.Issuer = "evil" })), opts: strict, expectedCode: CodeInvalidIssuer},
+		{name: "wrong audience", token: sign(with(func(c *jwt.RegisteredClaims) { c.Audience = jwt.ClaimStrings{"billing-api"} })), opts: strict, expectedCode: CodeInvalidAudience},
+		{name: "no options", token: sign(jwt.RegisteredClaims{}), opts: ValidationOptions{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Verify(tt.token, &jwt.MapClaims{}, keys, tt.opts)
+			if tt.expectedCode == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Error(t, err)
+			assert.Equal(t, tt.expectedCode, ErrorCode(err))
+		})
+	}
+}
+
+func TestValidationOptionsFromEnv(t *testing.T) {
+	t.Setenv("JWT_ALGORITHMS", "RS256, ES256")
+	t.Setenv("JWT_AUDIENCES", "accounts-api")
+	t.Setenv("JWT_LEEWAY", "45s")
+
+	opts, err := ValidationOptionsFromEnv(ValidationOptions{Algorithms: []string{"HS256"}, Issuers: []string{"keycloak"}})
+	assert.NoError(t, err)
+	assert.Equal(t, ValidationOptions{
+		Algorithms: []string{"RS256", "ES256"},
+		Issuers:    []string{"keycloak"},
+		Audiences:  []string{"accounts-api"},
+		Leeway:     45 * time.Second,
+	}, opts)
+
+	t.Setenv("JWT_MAX_AGE", "soon")
+	_, err = ValidationOptionsFromEnv(ValidationOptions{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,119 @@
+package authz
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Errors returned by VerifyBearer for requests without a usable Authorization header
+var (
+	ErrMissingToken  error = &authn.ValidationError{Code: authn.CodeTokenMissing, Message: "token missing"}
+	ErrInvalidHeader error = &authn.ValidationError{Code: authn.CodeTokenMalformed, Message: "invalid authorization header, want Bearer <token>"}
+)
+
+// ClaimsKey is the gin context key ClaimsContext stores the caller's claims under
+const ClaimsKey = "claims"
+
+// Claims is the payload of an access token. Tokens carry their roles as a
+// list, older ones a single role, the caller holds both.
+type Claims struct {
+	UserID string   `json:"user_id"`
+	Role   string   `json:"role,omitempty"`
+	Roles  []string `json:"roles,omitempty"`
+	Scopes []string `json:"scopes,omitempty"`
+	jwt.RegisteredClaims
+	// Attributes holds every claim of the token, custom ones such as department
+	// included, for policy conditions
+	Attributes map[string]interface{} `json:"-"`
+}
+
+// UnmarshalJSON decodes the known claims and keeps all of them in Attributes
+func (c *Claims) UnmarshalJSON(data []byte) error {
+	type claims Claims
+	if err := json.Unmarshal(data, (*claims)(c)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &c.Attributes)
+}
+
+// Subject describes the caller holding the claims for Authorize
+func (c *Claims) Subject() Subject {
+	roles := c.Roles
+	if c.Role != "" && !contains(roles, c.Role) {
+		roles = append(append([]string(nil), roles...), c.Role)
+	}
+	return Subject{UserID: c.UserID, Roles: roles, Scopes: c.Scopes, Attributes: c.Attributes}
+}
+
+// Authenticator returns the claims of the token in an Authorization header
+type Authenticator func(ctx context.Context, authHeader string) (*Claims, error)
+
+// VerifyBearer verifies the JWT in an Authorization: Bearer header
+func VerifyBearer(authHeader string, keys authn.KeyProvider, opts authn.ValidationOptions) (*Claims, error) {
+	if authHeader == "" {
+		return nil, ErrMissingToken
+	}
+	scheme, token, ok := strings.Cut(authHeader, " ")
+	if !ok || scheme != "Bearer" || token == "" {
+		return nil, ErrInvalidHeader
+	}
+
+	claims := &Claims{}
+	if err := authn.Verify(token, claims, keys, opts); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// ClaimsContext authenticates every request and stores the caller's claims
+// under ClaimsKey. Requests failing authentication answer 401 with the error
+// and its authn code.
+func ClaimsContext(authenticate Authenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		claims, err := authenticate(c.Request.Context(), c.GetHeader("Authorization"))
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error(), "code": authn.ErrorCode(err)})
+			c.Abort()
+			return
+		}
+		c.Set(ClaimsKey, claims)
+		c.Next()
+	}
+}
+
+// GetClaims returns the claims ClaimsContext stored
+func GetClaims(c *gin.Context) (*Claims, bool) {
+	claims, ok := Get[*Claims](c, ClaimsKey)
+	return claims, ok && claims != nil
+}
+
+// ClaimsSubject is the SubjectFunc for callers authenticated by ClaimsContext
+func ClaimsSubject(c *gin.Context) (Subject, bool) {
+	claims, ok := GetClaims(c)
+	if !ok {
+		return Subject{}, false
+	}
+	return claims.Subject(), true
+}
+
+// Get returns the value stored under key when it is a T
+func Get[T any](c *gin.Context, key string) (T, bool) {
+	value, _ := c.Get(key)
+	typed, ok := value.(T)
+	return typed, ok
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
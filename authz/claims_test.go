@@ -0,0 +1,92 @@
+package authz
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClaimsSubject(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   Claims
+		expected []string
+	}{
+		{name: "role list", claims: Claims{Roles: []string{"user"}}, expected: []string{"user"}},
+		{name: "single role", claims: Claims{Role: "admin"}, expected: []string{"admin"}},
+		{name: "both", claims: Claims{Role: "admin", Roles: []string{"user"}}, expected: []string{"user", "admin"}},
+		{name: "same role twice", claims: Claims{Role: "user", Roles: []string{"user"}}, expected: []string{"user"}},
+		{name: "no role", claims: Claims{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, tt.claims.Subject().Roles)
+		})
+	}
+}
+
+func TestVerifyBearer(t *testing.T) {
+	keys := authn.NewKeySet(authn.NewHMACKey("", []byte("secret")))
+	token, _ := keys.Active().Sign(Claims{
+		UserID:           "1",
+		Role:             "user",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+
+	claims, err := VerifyBearer("Bearer "+token, keys, authn.ValidationOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "1", claims.UserID)
+	assert.Equal(t, "user", claims.Attributes["role"])
+
+	tests := map[string]string{
+		"":                      authn.CodeTokenMissing,
+		"Basic dXNlcjpwdw==":    authn.CodeTokenMalformed,
+		"Bearer":                authn.CodeTokenMalformed,
+		"Bearer " + token + "x": authn.CodeInvalidSignature,
+	}
+	for header, code := range tests {
+		_, err := VerifyBearer(header, keys, authn.ValidationOptions{})
+		assert.Equal(t, code, authn.ErrorCode(err), header)
+	}
+}
+
+func TestClaimsContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	authenticate := func(_ context.Context, authHeader string) (*Claims, error) {
+		if authHeader != "Bearer good" {
+			return nil, ErrInvalidHeader
+		}
+		return &Claims{UserID: "1", Roles: []string{"user"}}, nil
+	}
+
+	r := gin.New()
+	r.Use(ClaimsContext(authenticate))
+	r.GET("/me", func(c *gin.Context) {
+		subject, ok := ClaimsSubject(c)
+		assert.True(t, ok)
+		c.JSON(http.StatusOK, subject)
+	})
+
+	for header, code := range map[string]int{"Bearer good": http.StatusOK, "Bearer bad": http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/me", nil)
+		req.Header.Set("Authorization", header)
+		r.ServeHTTP(w, req)
+		assert.Equal(t, code, w.Code, header)
+	}
+
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	_, ok := ClaimsSubject(c)
+	assert.False(t, ok)
+	c.Set(ClaimsKey, "not claims")
+	_, ok = GetClaims(c)
+	assert.False(t, ok)
+}
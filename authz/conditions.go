@@ -0,0 +1,275 @@
+package authz
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Condition operators
+const (
+	OpEqual       = "eq"
+	OpNotEqual    = "ne"
+	OpGreater     = "gt"
+	OpGreaterOrEq = "gte"
+	OpLess        = "lt"
+	OpLessOrEq    = "lte"
+	// OpIn and OpNotIn test the attribute against a list of values
+	OpIn    = "in"
+	OpNotIn = "not_in"
+	// OpContains and OpNotContains test a list attribute, e.g. subject.roles
+	OpContains    = "contains"
+	OpNotContains = "not_contains"
+	// OpCIDR and OpNotCIDR test an IP against a CIDR or a list of them
+	OpCIDR    = "cidr"
+	OpNotCIDR = "not_cidr"
+	// OpBetween and OpNotBetween test value[0] <= attribute < value[1],
+	// e.g. request.time between ["09:00", "17:00"]
+	OpBetween    = "between"
+	OpNotBetween = "not_between"
+)
+
+// Condition compares an attribute of the request with a value. Attributes are
+//
+//   - subject.user_id, subject.roles, subject.scopes and subject.<claim> for
+//     any other claim of the token, e.g. subject.department
+//   - request.method, request.route, request.ip, request.params.<name>,
+//     request.time as 15:04 and request.weekday as mon to sun, both in the
+//     policy's timezone
+//   - resource.<field> for the resource the route acts on, dots descend into
+//     nested fields
+type Condition struct {
+	Attribute string      `json:"attribute" yaml:"attribute"`
+	Operator  string      `json:"operator" yaml:"operator"`
+	Value     interface{} `json:"value" yaml:"value"`
+}
+
+// errMissingAttribute is returned when a condition's attribute is not set
+var errMissingAttribute = errors.New("attribute is not set")
+
+type compiledCondition struct {
+	condition Condition
+	test      func(attribute interface{}) bool
+}
+
+func compileCondition(c Condition) (*compiledCondition, error) {
+	prefix, path, _ := strings.Cut(c.Attribute, ".")
+	if path == "" || (prefix != "subject" && prefix != "request" && prefix != "resource") {
+		return nil, fmt.Errorf("attribute %q: must start with subject., request. or resource.", c.Attribute)
+	}
+
+	compiled := &compiledCondition{condition: c}
+	negate := false
+	switch c.Operator {
+	case OpEqual, OpNotEqual:
+		negate = c.Operator == OpNotEqual
+		compiled.test = func(a interface{}) bool { return equal(a, c.Value) }
+	case OpGreater, OpGreaterOrEq, OpLess, OpLessOrEq:
+		if _, ok := orderable(c.Value); !ok {
+			return nil, fmt.Errorf("attribute %q: %s needs a number or a string", c.Attribute, c.Operator)
+		}
+		op := c.Operator
+		compiled.test = func(a interface{}) bool {
+			n, ok := compare(a, c.Value)
+			return ok && (op == OpGreater && n > 0 || op == OpGreaterOrEq && n >= 0 || op == OpLess && n < 0 || op == OpLessOrEq && n <= 0)
+		}
+	case OpIn, OpNotIn:
+		negate = c.Operator == OpNotIn
+		values, ok := c.Value.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("attribute %q: %s needs a list", c.Attribute, c.Operator)
+		}
+		compiled.test = func(a interface{}) bool {
+			for _, v := range values {
+				if equal(a, v) {
+					return true
+				}
+			}
+			return false
+		}
+	case OpContains, OpNotContains:
+		negate = c.Operator == OpNotContains
+		compiled.test = func(a interface{}) bool {
+			for _, v := range list(a) {
+				if equal(v, c.Value) {
+					return true
+				}
+			}
+			return false
+		}
+	case OpCIDR, OpNotCIDR:
+		negate = c.Operator == OpNotCIDR
+		var networks []*net.IPNet
+		for _, v := range list(c.Value) {
+			_, network, err := net.ParseCIDR(fmt.Sprint(v))
+			if err != nil {
+				return nil, fmt.Errorf("attribute %q: %w", c.Attribute, err)
+			}
+			networks = append(networks, network)
+		}
+		compiled.test = func(a interface{}) bool {
+			ip := net.ParseIP(fmt.Sprint(a))
+			for _, network := range networks {
+				if ip != nil && network.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	case OpBetween, OpNotBetween:
+		negate = c.Operator == OpNotBetween
+		bounds, ok := c.Value.([]interface{})
+		if !ok || len(bounds) != 2 {
+			return nil, fmt.Errorf("attribute %q: %s needs a list of two bounds", c.Attribute, c.Operator)
+		}
+		compiled.test = func(a interface{}) bool {
+			low, okLow := compare(a, bounds[0])
+			high, okHigh := compare(a, bounds[1])
+			return okLow && okHigh && low >= 0 && high < 0
+		}
+	default:
+		return nil, fmt.Errorf("attribute %q: unknown operator %q", c.Attribute, c.Operator)
+	}
+
+	if negate {
+		test := compiled.test
+		compiled.test = func(a interface{}) bool { return !test(a) }
+	}
+	return compiled, nil
+}
+
+// eval reports whether the condition holds, or an error when its attribute is not set
+func (c *compiledCondition) eval(req Request, location *time.Location) (bool, error) {
+	value, ok := attribute(req, c.condition.Attribute, location)
+	if !ok {
+		return false, fmt.Errorf("%s: %w", c.condition.Attribute, errMissingAttribute)
+	}
+	return c.test(value), nil
+}
+
+func attribute(req Request, name string, location *time.Location) (interface{}, bool) {
+	prefix, path, _ := strings.Cut(name, ".")
+	switch prefix {
+	case "subject":
+		switch path {
+		case "user_id":
+			return req.Subject.UserID, req.Subject.UserID != ""
+		case "roles":
+			return req.Subject.Roles, true
+		case "scopes":
+			return req.Subject.Scopes, true
+		}
+		return lookup(req.Subject.Attributes, path)
+	case "request":
+		now := req.Time
+		if now.IsZero() {
+			now = time.Now()
+		}
+		switch path {
+		case "method":
+			return req.Method, true
+		case "route":
+			return req.Route, true
+		case "ip":
+			return req.IP, req.IP != ""
+		case "time":
+			return now.In(location).Format("15:04"), true
+		case "weekday":
+			return strings.ToLower(now.In(location).Weekday().String()[:3]), true
+		case "params":
+			return req.Params, true
+		}
+		if param, ok := strings.CutPrefix(path, "params."); ok {
+			value, ok := req.Params[param]
+			return value, ok
+		}
+	case "resource":
+		return lookup(req.Resource, path)
+	}
+	return nil, false
+}
+
+// lookup follows a dotted path through nested maps
+func lookup(values map[string]interface{}, path string) (interface{}, bool) {
+	var value interface{} = values
+	for _, part := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if value, ok = object[part]; !ok {
+			return nil, false
+		}
+	}
+	return value, value != nil
+}
+
+// list turns a slice of any element type into []interface{}, anything else into a one element list
+func list(value interface{}) []interface{} {
+	v := reflect.ValueOf(value)
+	if v.Kind() != reflect.Slice {
+		return []interface{}{value}
+	}
+	items := make([]interface{}, v.Len())
+	for i := range items {
+		items[i] = v.Index(i).Interface()
+	}
+	return items
+}
+
+// orderable returns a number as float64 or a string as is
+func orderable(value interface{}) (interface{}, bool) {
+	switch v := value.(type) {
+	case string:
+		return v, true
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case float32:
+		return float64(v), true
+	}
+	return nil, false
+}
+
+// compare orders two numbers or two strings, ok is false for anything else
+func compare(a, b interface{}) (int, bool) {
+	a, okA := orderable(a)
+	b, okB := orderable(b)
+	if !okA || !okB {
+		return 0, false
+	}
+	switch a := a.(type) {
+	case float64:
+		b, ok := b.(float64)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case a < b:
+			return -1, true
+		case a > b:
+			return 1, true
+		}
+		return 0, true
+	case string:
+		b, ok := b.(string)
+		if !ok {
+			return 0, false
+		}
+		return strings.Compare(a, b), true
+	}
+	return 0, false
+}
+
+func equal(a, b interface{}) bool {
+	if n, ok := compare(a, b); ok {
+		return n == 0
+	}
+	return reflect.DeepEqual(a, b)
+}
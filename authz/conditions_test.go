@@ -0,0 +1,87 @@
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConditions(t *testing.T) {
+	// Wednesday 14:30 in Bangkok
+	bangkok, _ := time.LoadLocation("Asia/Bangkok")
+	now := time.Date(2024, 1, 3, 14, 30, 0, 0, bangkok)
+
+	req := Request{
+		Method: "GET",
+		Route:  "/accounts/:id",
+		Params: map[string]string{"id": "1"},
+		IP:     "10.1.2.3",
+		Time:   now,
+		Subject: Subject{
+			UserID:     "user1",
+			Roles:      []string{"user", "auditor"},
+			Attributes: map[string]interface{}{"department": "finance", "level": float64(3)},
+		},
+		Resource: map[string]interface{}{"amount": 12000, "owner": map[string]interface{}{"id": "user1"}},
+	}
+
+	tests := []struct {
+		condition Condition
+		expected  bool
+		missing   bool
+	}{
+		{condition: Condition{"resource.amount", OpGreater, 10000}, expected: true},
+		{condition: Condition{"resource.amount", OpLessOrEq, 10000}},
+		{condition: Condition{"resource.amount", OpBetween, []interface{}{0, 12000}}},
+		{condition: Condition{"resource.owner.id", OpEqual, "user1"}, expected: true},
+		{condition: Condition{"resource.missing", OpEqual, "x"}, missing: true},
+		{condition: Condition{"subject.department", OpIn, []interface{}{"finance", "audit"}}, expected: true},
+		{condition: Condition{"subject.department", OpNotEqual, "finance"}},
+		{condition: Condition{"subject.level", OpGreaterOrEq, 3}, expected: true},
+		{condition: Condition{"subject.roles", OpContains, "auditor"}, expected: true},
+		{condition: Condition{"subject.roles", OpNotContains, "admin"}, expected: true},
+		{condition: Condition{"subject.user_id", OpEqual, "user1"}, expected: true},
+		{condition: Condition{"request.ip", OpCIDR, []interface{}{"192.168.0.0/16", "10.0.0.0/8"}}, expected: true},
+		{condition: Condition{"request.ip", OpNotCIDR, "10.0.0.0/8"}},
+		{condition: Condition{"request.time", OpBetween, []interface{}{"09:00", "17:00"}}, expected: true},
+		{condition: Condition{"request.time", OpNotBetween, []interface{}{"09:00", "14:30"}}, expected: true},
+		{condition: Condition{"request.weekday", OpIn, []interface{}{"mon", "tue", "wed", "thu", "fri"}}, expected: true},
+		{condition: Condition{"request.params.id", OpEqual, "1"}, expected: true},
+		{condition: Condition{"request.method", OpEqual, "GET"}, expected: true},
+	}
+
+	for _, tt := range tests {
+		c := tt.condition
+		t.Run(c.Attribute+" "+c.Operator, func(t *testing.T) {
+			compiled, err := compileCondition(c)
+			assert.NoError(t, err)
+
+			holds, err := compiled.eval(req, bangkok)
+			if tt.missing {
+				assert.ErrorIs(t, err, errMissingAttribute)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, holds)
+		})
+	}
+}
+
+func TestCompileConditionErrors(t *testing.T) {
+	tests := []Condition{
+		{"amount", OpGreater, 1},
+		{"resource.amount", "approximately", 1},
+		{"resource.amount", OpGreater, []interface{}{1}},
+		{"resource.kind", OpIn, "account"},
+		{"request.ip", OpCIDR, "10.0.0.0"},
+		{"request.time", OpBetween, []interface{}{"09:00"}},
+	}
+
+	for _, c := range tests {
+		t.Run(c.Attribute+" "+c.Operator, func(t *testing.T) {
+			_, err := compileCondition(c)
+			assert.Error(t, err)
+		})
+	}
+}
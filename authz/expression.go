@@ -0,0 +1,173 @@
+package authz
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/google/cel-go/cel"
+)
+
+// Schema declares the custom subject claims and the resource fields
+// expressions may use, by name and type. Types are string, int, double, bool,
+// list (of strings), map (of strings to strings) and dyn.
+type Schema struct {
+	Subject  map[string]string `json:"subject,omitempty" yaml:"subject,omitempty"`
+	Resource map[string]string `json:"resource,omitempty" yaml:"resource,omitempty"`
+}
+
+var schemaTypes = map[string]*cel.Type{
+	"string": cel.StringType,
+	"int":    cel.IntType,
+	"double": cel.DoubleType,
+	"bool":   cel.BoolType,
+	"list":   cel.ListType(cel.StringType),
+	"map":    cel.MapType(cel.StringType, cel.StringType),
+	"dyn":    cel.DynType,
+}
+
+// builtinAttributes are declared for every policy
+var builtinAttributes = map[string]string{
+	"subject.user_id": "string",
+	"subject.roles":   "list",
+	"subject.scopes":  "list",
+	"request.method":  "string",
+	"request.route":   "string",
+	"request.ip":      "string",
+	"request.time":    "string",
+	"request.weekday": "string",
+	"request.params":  "map",
+}
+
+// expressions compiles the when expressions of one policy
+type expressions struct {
+	env        *cel.Env
+	attributes map[string]string
+}
+
+func newExpressions(schema Schema) (*expressions, error) {
+	e := &expressions{attributes: map[string]string{}}
+	for name, typ := range builtinAttributes {
+		e.attributes[name] = typ
+	}
+	for prefix, fields := range map[string]map[string]string{"subject": schema.Subject, "resource": schema.Resource} {
+		for field, typ := range fields {
+			name := prefix + "." + field
+			if _, ok := builtinAttributes[name]; ok {
+				return nil, fmt.Errorf("schema: %s is built in", name)
+			}
+			e.attributes[name] = typ
+		}
+	}
+
+	// Sorted so errors are reported the same way on every run
+	names := make([]string, 0, len(e.attributes))
+	for name := range e.attributes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var options []cel.EnvOption
+	for _, name := range names {
+		typ, ok := schemaTypes[e.attributes[name]]
+		if !ok {
+			return nil, fmt.Errorf("schema: %s has unknown type %q", name, e.attributes[name])
+		}
+		options = append(options, cel.Variable(name, typ))
+	}
+
+	env, err := cel.NewEnv(options...)
+	if err != nil {
+		return nil, err
+	}
+	e.env = env
+	return e, nil
+}
+
+// compile type checks an expression, it must evaluate to a bool
+func (e *expressions) compile(expression string) (cel.Program, error) {
+	ast, issues := e.env.Compile(expression)
+	if issues != nil && issues.Err() != nil {
+		return nil, issues.Err()
+	}
+	if ast.OutputType() != cel.BoolType {
+		return nil, fmt.Errorf("expression %q: must be a bool, not %s", expression, ast.OutputType())
+	}
+	return e.env.Program(ast)
+}
+
+// eval runs a compiled expression against the request. Attributes that are
+// not set, or not of their declared type, make evaluation fail.
+func (e *expressions) eval(program cel.Program, req Request, location *time.Location) (bool, error) {
+	activation := map[string]interface{}{}
+	for name, typ := range e.attributes {
+		value, ok := attribute(req, name, location)
+		if !ok {
+			continue
+		}
+		if value, ok = convert(value, typ); ok {
+			activation[name] = value
+		}
+	}
+
+	out, _, err := program.Eval(activation)
+	if err != nil {
+		return false, err
+	}
+	result, ok := out.Value().(bool)
+	return ok && result, nil
+}
+
+// convert turns decoded claims and resource fields into the declared type
+func convert(value interface{}, typ string) (interface{}, bool) {
+	switch typ {
+	case "string":
+		s, ok := value.(string)
+		return s, ok
+	case "bool":
+		b, ok := value.(bool)
+		return b, ok
+	case "int":
+		switch v := value.(type) {
+		case int:
+			return int64(v), true
+		case int64:
+			return v, true
+		case float64:
+			return int64(v), v == float64(int64(v))
+		}
+	case "double":
+		if n, ok := orderable(value); ok {
+			f, ok := n.(float64)
+			return f, ok
+		}
+	case "list":
+		var items []string
+		for _, item := range list(value) {
+			s, ok := item.(string)
+			if !ok {
+				return nil, false
+			}
+			items = append(items, s)
+		}
+		return items, true
+	case "map":
+		switch v := value.(type) {
+		case map[string]string:
+			return v, true
+		case map[string]interface{}:
+			m := make(map[string]string, len(v))
+			for key, item := range v {
+				s, ok := item.(string)
+				if !ok {
+					return nil, false
+				}
+				m[key] = s
+			}
+			return m, true
+		}
+	case "dyn":
+		return value, true
+	}
+	return nil, false
+}
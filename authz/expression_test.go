@@ -0,0 +1,117 @@
+package authz
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExpressions(t *testing.T) {
+	e, err := newExpressions(Schema{
+		Subject:  map[string]string{"department": "string", "level": "int"},
+		Resource: map[string]string{"user_id": "string", "amount": "double", "tags": "list"},
+	})
+	assert.NoError(t, err)
+
+	req := Request{
+		Method: "GET",
+		Params: map[string]string{"id": "1"},
+		Subject: Subject{
+			UserID:     "user1",
+			Roles:      []string{"user"},
+			Attributes: map[string]interface{}{"department": "finance", "level": float64(3)},
+		},
+		Resource: map[string]interface{}{"user_id": "user1", "amount": 12000, "tags": []interface{}{"vip"}},
+	}
+
+	tests := []struct {
+		expression string
+		expected   bool
+		missing    bool
+	}{
+		{expression: `resource.user_id == subject.user_id || "admin" in subject.roles`, expected: true},
+		{expression: `"admin" in subject.roles`},
+		{expression: `resource.amount > 10000.0 && subject.level >= 3`, expected: true},
+		{expression: `subject.department == "finance" && "vip" in resource.tags`, expected: true},
+		{expression: `request.params.id == "1" && request.method == "GET"`, expected: true},
+		{expression: `request.ip == "10.0.0.1"`, missing: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.expression, func(t *testing.T) {
+			program, err := e.compile(tt.expression)
+			assert.NoError(t, err)
+
+			holds, err := e.eval(program, req, time.UTC)
+			if tt.missing {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, holds)
+		})
+	}
+}
+
+func TestExpressionErrors(t *testing.T) {
+	e, _ := newExpressions(Schema{Resource: map[string]string{"user_id": "string"}})
+
+	tests := []string{
+		`resource.owner == subject.user_id`,
+		`resource.user_id == 1`,
+		`resource.user_id`,
+		`subject.user_id ==`,
+	}
+
+	for _, expression := range tests {
+		t.Run(expression, func(t *testing.T) {
+			_, err := e.compile(expression)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := newExpressions(Schema{Resource: map[string]string{"user_id": "uuid"}})
+	assert.Error(t, err)
+	_, err = newExpressions(Schema{Subject: map[string]string{"user_id": "string"}})
+	assert.Error(t, err)
+}
+
+func TestExpressionsInPolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+schema:
+  resource: {user_id: string}
+rules:
+  - method: GET
+    path: /accounts/:id
+    roles: [user]
+    when: resource.user_id == subject.user_id || "admin" in subject.roles
+`))
+	assert.NoError(t, err)
+	authorizer, err := NewAuthorizer(policy, DefaultRoleRegistry, DefaultMatcher)
+	assert.NoError(t, err)
+
+	account := map[string]interface{}{"user_id": "user1"}
+	tests := []struct {
+		name     string
+		subject  Subject
+		resource map[string]interface{}
+		expected bool
+	}{
+		{name: "owner", subject: Subject{UserID: "user1", Roles: []string{"user"}}, resource: account, expected: true},
+		{name: "admin", subject: Subject{UserID: "admin1", Roles: []string{"admin"}}, resource: account, expected: true},
+		{name: "someone else", subject: Subject{UserID: "user2", Roles: []string{"user"}}, resource: account},
+		{name: "fails closed without the resource", subject: Subject{UserID: "user1", Roles: []string{"user"}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := authorizer.Authorize(Request{Method: "GET", Route: "/accounts/:id", Subject: tt.subject, Resource: tt.resource})
+			assert.Equal(t, tt.expected, decision.Allowed, decision.Reason)
+		})
+	}
+
+	policy.Rules[0].When = `resource.name == "x"`
+	_, err = NewAuthorizer(policy, DefaultRoleRegistry, DefaultMatcher)
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package authz
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// DecisionHeader carries the Decision as JSON when debugging is on
+const DecisionHeader = "X-Authz-Decision"
+
+// SubjectFunc returns the caller authenticated by an earlier middleware
+type SubjectFunc func(c *gin.Context) (Subject, bool)
+
+// ResourceFunc returns the attributes of the resource a request acts on, nil
+// when there is none. It may abort the request, e.g. when the resource does
+// not exist.
+type ResourceFunc func(c *gin.Context) map[string]interface{}
+
+// Middleware enforces the policy in force on every route it is installed in
+// front of. resource may be nil for programs without resource conditions.
+func (s *PolicyStore) Middleware(subject SubjectFunc, resource ResourceFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, ok := subject(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "the claims do not exist"})
+			c.Abort()
+			return
+		}
+
+		req := RequestFromContext(c, caller)
+		if resource != nil {
+			// resource may answer the request itself, e.g. with a 404
+			if req.Resource = resource(c); c.IsAborted() {
+				return
+			}
+		}
+		decision := s.Authorizer().Authorize(req)
+		if s.LogDecision != nil {
+			s.LogDecision(req, decision)
+		}
+		if s.Shadow != nil {
+			s.Shadow.Compare(req, decision)
+		}
+		if s.Debug {
+			setDecisionHeader(c, decision)
+		}
+		if !decision.Allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// RequestFromContext describes the matched gin route for Authorize. IP is the
+// address of the connection, X-Forwarded-For is set by the client and not trusted.
+func RequestFromContext(c *gin.Context, subject Subject) Request {
+	params := make(map[string]string, len(c.Params))
+	for _, p := range c.Params {
+		params[p.Key] = p.Value
+	}
+	return Request{
+		Method:  c.Request.Method,
+		Route:   c.FullPath(),
+		Params:  params,
+		Subject: subject,
+		IP:      c.RemoteIP(),
+		Time:    time.Now(),
+	}
+}
+
+func setDecisionHeader(c *gin.Context, decision Decision) {
+	data, err := json.Marshal(decision)
+	if err != nil {
+		return
+	}
+	c.Header(DecisionHeader, string(data))
+}
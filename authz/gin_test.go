@@ -0,0 +1,32 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestFromContext(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	var got Request
+	r := gin.New()
+	r.GET("/accounts/:id", func(c *gin.Context) {
+		got = RequestFromContext(c, Subject{UserID: "user1"})
+	})
+
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/accounts/1", nil)
+	req.RemoteAddr = "192.0.2.7:51234"
+	req.Header.Set("X-Forwarded-For", "10.1.2.3")
+	req.Header.Set("X-Real-IP", "10.1.2.3")
+	r.ServeHTTP(w, req)
+
+	assert.Equal(t, "GET", got.Method)
+	assert.Equal(t, "/accounts/:id", got.Route)
+	assert.Equal(t, map[string]string{"id": "1"}, got.Params)
+	assert.Equal(t, "user1", got.Subject.UserID)
+	assert.Equal(t, "192.0.2.7", got.IP, "forwarding headers are set by the client and ignored")
+}
@@ -0,0 +1,434 @@
+package authz
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/cel-go/cel"
+	"gopkg.in/yaml.v3"
+)
+
+// Rule effects
+const (
+	Allow = "allow"
+	Deny  = "deny"
+)
+
+// Combining algorithms decide between rules of a route that disagree. When no
+// rule applies the request is denied whatever the algorithm.
+const (
+	// DenyOverrides denies when any deny rule applies, the most restrictive choice
+	DenyOverrides = "deny-overrides"
+	// PermitOverrides allows when any allow rule applies
+	PermitOverrides = "permit-overrides"
+	// FirstApplicable takes the effect of the first rule that applies, in document order
+	FirstApplicable = "first-applicable"
+)
+
+// Any is the method or path of a rule that applies to every route
+const Any = "*"
+
+// Rule allows or denies access to a route
+type Rule struct {
+	// Effect is allow, the default, or deny
+	Effect string `json:"effect,omitempty" yaml:"effect,omitempty"`
+	Method string `json:"method" yaml:"method"`
+	// Path is the route as registered with gin, e.g. /accounts/:id
+	Path string `json:"path" yaml:"path"`
+	// Roles limits the rule to callers with one of the roles, or a role
+	// inheriting one of them. Empty applies to any role.
+	Roles []string `json:"roles,omitempty" yaml:"roles,omitempty"`
+	// Scopes of an allow rule are required, the caller needs any one of them
+	// granted explicitly or through a role. Scopes of a deny rule are patterns,
+	// it applies to callers holding a scope any of them covers, e.g.
+	// user:write:*. Empty applies whatever the caller's scopes.
+	Scopes []string `json:"scopes,omitempty" yaml:"scopes,omitempty"`
+	// Owner names the path parameter holding the owner's user id, or an
+	// attribute such as resource.user_id, self scopes only match when it is the
+	// caller's. Without it ownership is left to the handler.
+	Owner string `json:"owner,omitempty" yaml:"owner,omitempty"`
+	// Conditions must all hold for the rule to apply, they are evaluated after
+	// the roles and scopes match. A condition whose attribute is not set fails
+	// closed: an allow rule does not apply, a deny rule does.
+	Conditions []Condition `json:"conditions,omitempty" yaml:"conditions,omitempty"`
+	// When is a CEL expression that must hold for the rule to apply, e.g.
+	// resource.user_id == subject.user_id || "admin" in subject.roles. It is
+	// type checked against the policy's schema and fails closed like Conditions.
+	When string `json:"when,omitempty" yaml:"when,omitempty"`
+}
+
+// Policy is the route authorization document. Routes without a rule are denied.
+type Policy struct {
+	// Algorithm combines the rules of a route, deny-overrides by default
+	Algorithm string `json:"algorithm,omitempty" yaml:"algorithm,omitempty"`
+	// Timezone is the IANA zone of request.time and request.weekday, UTC by default
+	Timezone string `json:"timezone,omitempty" yaml:"timezone,omitempty"`
+	// Schema declares the attributes When expressions may use besides the built in ones
+	Schema Schema `json:"schema,omitempty" yaml:"schema,omitempty"`
+	Rules  []Rule `json:"rules" yaml:"rules"`
+}
+
+// ParsePolicy reads a policy in YAML, which also accepts JSON
+func ParsePolicy(data []byte) (Policy, error) {
+	var policy Policy
+	if err := yaml.Unmarshal(data, &policy); err != nil {
+		return Policy{}, err
+	}
+	return policy, nil
+}
+
+// LoadPolicy reads a YAML or JSON policy file
+func LoadPolicy(path string) (Policy, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return Policy{}, fmt.Errorf("%s: %w", path, err)
+	}
+	return policy, nil
+}
+
+// Subject is the caller a request is authorized for
+type Subject struct {
+	UserID string   `json:"user_id"`
+	Roles  []string `json:"roles"`
+	Scopes []string `json:"scopes"`
+	// Attributes holds the other claims of the caller, e.g. department
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// Request is what the Authorizer decides on
+type Request struct {
+	Method string `json:"method"`
+	// Route is the registered route, not the requested URL
+	Route   string            `json:"route"`
+	Params  map[string]string `json:"params,omitempty"`
+	Subject Subject           `json:"subject"`
+	IP      string            `json:"ip,omitempty"`
+	// Time is when the request was made, now when zero
+	Time time.Time `json:"time"`
+	// Resource holds the attributes of the resource the route acts on, nil
+	// when it is not known
+	Resource map[string]interface{} `json:"resource,omitempty"`
+}
+
+// Decision is the outcome of Authorize
+type Decision struct {
+	Allowed bool `json:"allowed"`
+	// Rule is the rule that decided, nil when no rule applied
+	Rule *Rule `json:"matched_rule,omitempty"`
+	// Candidate is the allow rule the explanation is about when no rule applied
+	Candidate *Rule  `json:"candidate_rule,omitempty"`
+	Reason    string `json:"reason,omitempty"`
+	// MissingScopes are the scopes of Candidate, any one of which would have matched
+	MissingScopes []string `json:"missing_scopes,omitempty"`
+	// FailedCondition is the condition or expression of Candidate that did not hold
+	FailedCondition string `json:"failed_condition,omitempty"`
+	// Roles are the caller's roles and the roles they inherit
+	Roles []string `json:"roles,omitempty"`
+	// Relation is the relation checked after the policy allowed, e.g. account:1#viewer
+	Relation string `json:"relation,omitempty"`
+	// Version is the version of the policy that decided
+	Version string `json:"policy_version,omitempty"`
+}
+
+type compiledRule struct {
+	rule       Rule
+	scopes     []Scope
+	conditions []*compiledCondition
+	when       cel.Program
+}
+
+// Authorizer enforces a Policy. It is compiled once and read only afterwards.
+type Authorizer struct {
+	version   string
+	algorithm string
+	rules     []*compiledRule
+	// routes indexes rules by route, wildcards lists the rules with a * method or path
+	routes      map[string][]int
+	wildcards   []int
+	location    *time.Location
+	expressions *expressions
+	roles       *RoleRegistry
+	matcher     *Matcher
+}
+
+// NewAuthorizer validates and compiles a policy. Roles in rules are resolved
+// through roles, scopes are matched with matcher.
+func NewAuthorizer(policy Policy, roles *RoleRegistry, matcher *Matcher) (*Authorizer, error) {
+	// The version only changes with the rules, not with the formatting of the file
+	canonical, err := json.Marshal(policy)
+	if err != nil {
+		return nil, err
+	}
+	sum := sha256.Sum256(canonical)
+
+	a := &Authorizer{
+		version:   hex.EncodeToString(sum[:8]),
+		algorithm: policy.Algorithm,
+		routes:    map[string][]int{},
+		roles:     roles,
+		matcher:   matcher,
+	}
+	switch a.algorithm {
+	case "":
+		a.algorithm = DenyOverrides
+	case DenyOverrides, PermitOverrides, FirstApplicable:
+	default:
+		return nil, fmt.Errorf("unknown combining algorithm %q", policy.Algorithm)
+	}
+	if a.location, err = time.LoadLocation(policy.Timezone); err != nil {
+		return nil, err
+	}
+	if a.expressions, err = newExpressions(policy.Schema); err != nil {
+		return nil, err
+	}
+
+	for i, rule := range policy.Rules {
+		rule.Method = strings.ToUpper(rule.Method)
+		if rule.Method == "" || (rule.Path != Any && !strings.HasPrefix(rule.Path, "/")) {
+			return nil, fmt.Errorf("rule %d: method and an absolute path are required", i)
+		}
+		switch rule.Effect {
+		case "":
+			rule.Effect = Allow
+		case Allow, Deny:
+		default:
+			return nil, fmt.Errorf("rule %d: effect must be %s or %s", i, Allow, Deny)
+		}
+		for _, role := range rule.Roles {
+			if _, ok := roles.scopes[role]; !ok {
+				return nil, fmt.Errorf("rule %d: role %q is not defined", i, role)
+			}
+		}
+		compiled := &compiledRule{rule: rule}
+		for _, s := range rule.Scopes {
+			scope, err := ParseScope(s)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			compiled.scopes = append(compiled.scopes, scope)
+		}
+		for _, c := range rule.Conditions {
+			condition, err := compileCondition(c)
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+			compiled.conditions = append(compiled.conditions, condition)
+		}
+		if rule.When != "" {
+			if compiled.when, err = a.expressions.compile(rule.When); err != nil {
+				return nil, fmt.Errorf("rule %d: %w", i, err)
+			}
+		}
+
+		a.rules = append(a.rules, compiled)
+		if rule.Method == Any || rule.Path == Any {
+			a.wildcards = append(a.wildcards, i)
+		} else {
+			key := routeKey(rule.Method, rule.Path)
+			a.routes[key] = append(a.routes[key], i)
+		}
+	}
+	return a, nil
+}
+
+// MustAuthorizer is NewAuthorizer for policies shipped with the program, it panics on error
+func MustAuthorizer(policy Policy, roles *RoleRegistry, matcher *Matcher) *Authorizer {
+	a, err := NewAuthorizer(policy, roles, matcher)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// Version identifies the policy, it is used as its etag
+func (a *Authorizer) Version() string {
+	return a.version
+}
+
+func routeKey(method, path string) string {
+	return method + " " + path
+}
+
+// Authorize decides whether the subject may call the route
+func (a *Authorizer) Authorize(req Request) Decision {
+	decision := a.authorize(req)
+	decision.Roles = a.roles.Expand(req.Subject.Roles...)
+	decision.Version = a.version
+	return decision
+}
+
+func (a *Authorizer) authorize(req Request) Decision {
+	rules := a.rulesFor(req.Method, req.Route)
+	if len(rules) == 0 {
+		return Decision{Reason: "no rule for " + routeKey(req.Method, req.Route)}
+	}
+
+	var allowed, denied *Rule
+	// When nothing applies, the explanation is why the first allow rule did not
+	var explanation Decision
+	for _, compiled := range rules {
+		applies, why := a.applies(compiled, req)
+		if !applies {
+			if explanation.Candidate == nil && compiled.rule.Effect == Allow {
+				explanation = why
+				explanation.Candidate = &compiled.rule
+			}
+			continue
+		}
+
+		if compiled.rule.Effect == Deny && denied == nil {
+			denied = &compiled.rule
+		}
+		if compiled.rule.Effect == Allow && allowed == nil {
+			allowed = &compiled.rule
+		}
+		if a.algorithm == FirstApplicable {
+			break
+		}
+	}
+
+	switch {
+	case denied != nil && (allowed == nil || a.algorithm != PermitOverrides):
+		return Decision{Rule: denied, Reason: "denied by rule"}
+	case allowed != nil:
+		return Decision{Allowed: true, Rule: allowed}
+	case explanation.Candidate == nil:
+		explanation.Reason = "no rule allows " + routeKey(req.Method, req.Route)
+	}
+	return explanation
+}
+
+// HasRules reports whether any rule, a deny rule included, applies to the route
+func (a *Authorizer) HasRules(method, route string) bool {
+	return len(a.rulesFor(method, route)) > 0
+}
+
+// rulesFor returns the rules of a route in document order
+func (a *Authorizer) rulesFor(method, route string) []*compiledRule {
+	indexes := append([]int{}, a.routes[routeKey(method, route)]...)
+	for _, i := range a.wildcards {
+		rule := a.rules[i].rule
+		if (rule.Method == Any || rule.Method == method) && (rule.Path == Any || rule.Path == route) {
+			indexes = append(indexes, i)
+		}
+	}
+	sort.Ints(indexes)
+
+	rules := make([]*compiledRule, len(indexes))
+	for n, i := range indexes {
+		rules[n] = a.rules[i]
+	}
+	return rules
+}
+
+// applies reports whether the rule applies to the request, or why not
+func (a *Authorizer) applies(compiled *compiledRule, req Request) (bool, Decision) {
+	if ok, why := a.matches(compiled, req); !ok {
+		return false, why
+	}
+
+	for _, condition := range compiled.conditions {
+		holds, err := condition.eval(req, a.location)
+		c := condition.condition
+		failed := fmt.Sprintf("%s %s %v", c.Attribute, c.Operator, c.Value)
+		switch {
+		case err != nil && compiled.rule.Effect == Deny:
+			return true, Decision{}
+		case err != nil:
+			return false, Decision{Reason: "condition not evaluated: " + err.Error(), FailedCondition: failed}
+		case !holds:
+			return false, Decision{Reason: "condition failed: " + failed, FailedCondition: failed}
+		}
+	}
+
+	if compiled.when != nil {
+		holds, err := a.expressions.eval(compiled.when, req, a.location)
+		switch {
+		case err != nil && compiled.rule.Effect == Deny:
+			return true, Decision{}
+		case err != nil:
+			return false, Decision{Reason: "expression not evaluated: " + err.Error(), FailedCondition: compiled.rule.When}
+		case !holds:
+			return false, Decision{Reason: "expression failed: " + compiled.rule.When, FailedCondition: compiled.rule.When}
+		}
+	}
+	return true, Decision{}
+}
+
+func (a *Authorizer) matches(compiled *compiledRule, req Request) (bool, Decision) {
+	rule := &compiled.rule
+	subject := req.Subject
+
+	if len(rule.Roles) > 0 && !a.hasRole(subject.Roles, rule.Roles) {
+		return false, Decision{Reason: "role not allowed"}
+	}
+	if len(compiled.scopes) == 0 {
+		return true, Decision{}
+	}
+
+	// Roles come first, then the scopes granted explicitly
+	granted := append(a.roles.Scopes(subject.Roles...), ParseScopes(subject.Scopes)...)
+
+	if rule.Effect == Deny {
+		for _, pattern := range compiled.scopes {
+			for _, g := range granted {
+				if a.matcher.Covers(pattern, g) {
+					return true, Decision{}
+				}
+			}
+		}
+		return false, Decision{Reason: "no denied scope held"}
+	}
+
+	var isOwner func() bool
+	if rule.Owner != "" {
+		isOwner = func() bool {
+			owner, ok := a.owner(rule.Owner, req)
+			return ok && subject.UserID != "" && subject.UserID == owner
+		}
+	}
+	if _, ok := a.matcher.MatchAny(granted, compiled.scopes, isOwner); !ok {
+		// A self scope that would match for the owner is not a missing scope
+		if _, self := a.matcher.MatchAny(granted, compiled.scopes, nil); self {
+			name := ":" + rule.Owner
+			if strings.Contains(rule.Owner, ".") {
+				name = rule.Owner
+			}
+			return false, Decision{Reason: "not the owner of " + name}
+		}
+		return false, Decision{Reason: "missing scope", MissingScopes: rule.Scopes}
+	}
+	return true, Decision{}
+}
+
+// owner returns the owner's user id, from a path parameter or an attribute with a dot in its name
+func (a *Authorizer) owner(name string, req Request) (string, bool) {
+	if !strings.Contains(name, ".") {
+		owner, ok := req.Params[name]
+		return owner, ok
+	}
+	value, ok := attribute(req, name, a.location)
+	owner, isString := value.(string)
+	return owner, ok && isString
+}
+
+func (a *Authorizer) hasRole(roles []string, allowed []string) bool {
+	for _, role := range roles {
+		for _, allow := range allowed {
+			if a.roles.Is(role, allow) {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,297 @@
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testPolicy = `
+rules:
+  - method: GET
+    path: /accounts
+    roles: [admin]
+  - method: get
+    path: /accounts/:id
+    roles: [user]
+    scopes: [user:read:self, admin:read:all]
+    owner: id
+  - method: PUT
+    path: /accounts/:id
+    scopes: [user:write:self]
+`
+
+func TestAuthorize(t *testing.T) {
+	policy, err := ParsePolicy([]byte(testPolicy))
+	assert.NoError(t, err)
+	authorizer, err := NewAuthorizer(policy, DefaultRoleRegistry, DefaultMatcher)
+	assert.NoError(t, err)
+
+	user := Subject{UserID: "1", Roles: []string{"user"}}
+	admin := Subject{UserID: "admin1", Roles: []string{"admin"}}
+	scoped := Subject{UserID: "2", Scopes: []string{"user:write:self"}}
+
+	tests := []struct {
+		name     string
+		method   string
+		route    string
+		params   map[string]string
+		subject  Subject
+		expected bool
+		reason   string
+	}{
+		{name: "admin lists accounts", method: "GET", route: "/accounts", subject: admin, expected: true},
+		{name: "user cannot list accounts", method: "GET", route: "/accounts", subject: user, reason: "role not allowed"},
+		{name: "user reads own account", method: "GET", route: "/accounts/:id", params: map[string]string{"id": "1"}, subject: user, expected: true},
+		{name: "user cannot read another account", method: "GET", route: "/accounts/:id", params: map[string]string{"id": "2"}, subject: user, reason: "not the owner of :id"},
+		{name: "admin inherits user and reads any account", method: "GET", route: "/accounts/:id", params: map[string]string{"id": "2"}, subject: admin, expected: true},
+		{name: "explicit scope without a role", method: "PUT", route: "/accounts/:id", params: map[string]string{"id": "2"}, subject: scoped, expected: true},
+		{name: "route without a rule is denied", method: "DELETE", route: "/accounts/:id", subject: admin, reason: "no rule for DELETE /accounts/:id"},
+		{name: "unknown route is denied", method: "GET", route: "", subject: admin, reason: "no rule for GET "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := authorizer.Authorize(Request{Method: tt.method, Route: tt.route, Params: tt.params, Subject: tt.subject})
+			assert.Equal(t, tt.expected, decision.Allowed)
+			assert.Equal(t, tt.reason, decision.Reason)
+		})
+	}
+}
+
+func TestOwnerAttribute(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+rules:
+  - method: PUT
+    path: /profiles/:id
+    scopes: [user:write:self, admin:write:all]
+    owner: resource.user_id
+`))
+	assert.NoError(t, err)
+	authorizer, err := NewAuthorizer(policy, DefaultRoleRegistry, DefaultMatcher)
+	assert.NoError(t, err)
+
+	subject := Subject{UserID: "1", Scopes: []string{"user:write:self"}}
+	profile := func(owner string) Request {
+		return Request{Method: "PUT", Route: "/profiles/:id", Params: map[string]string{"id": "7"}, Subject: subject, Resource: map[string]interface{}{"user_id": owner}}
+	}
+
+	assert.True(t, authorizer.Authorize(profile("1")).Allowed)
+	decision := authorizer.Authorize(profile("2"))
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "not the owner of resource.user_id", decision.Reason)
+}
+
+func TestNewAuthorizerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rule Rule
+	}{
+		{name: "missing method", rule: Rule{Path: "/accounts"}},
+		{name: "relative path", rule: Rule{Method: "GET", Path: "accounts"}},
+		{name: "undefined role", rule: Rule{Method: "GET", Path: "/accounts", Roles: []string{"root"}}},
+		{name: "malformed scope", rule: Rule{Method: "GET", Path: "/accounts", Scopes: []string{"accounts:read"}}},
+		{name: "unknown effect", rule: Rule{Effect: "maybe", Method: "GET", Path: "/accounts"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewAuthorizer(Policy{Rules: []Rule{tt.rule}}, DefaultRoleRegistry, DefaultMatcher)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := NewAuthorizer(Policy{Algorithm: "majority-vote"}, DefaultRoleRegistry, DefaultMatcher)
+	assert.Error(t, err)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	os.WriteFile(path, []byte(`{"rules": [{"method": "GET", "path": "/accounts", "roles": ["admin"]}]}`), 0o600)
+
+	policy, err := LoadPolicy(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []Rule{{Method: "GET", Path: "/accounts", Roles: []string{"admin"}}}, policy.Rules)
+
+	_, err = LoadPolicy(filepath.Join(t.TempDir(), "missing.yaml"))
+	assert.Error(t, err)
+}
+
+// The README's conflicting permissions examples under each combining algorithm
+func TestCombiningAlgorithms(t *testing.T) {
+	// Admins hold admin:read:all and, through the user role, user:read:self
+	rules := `
+rules:
+  # Self access to personal data takes precedence over admin access
+  - {effect: deny, method: GET, path: /profiles/:id, roles: [admin]}
+  - {method: GET, path: /profiles/:id, scopes: [user:read:self, admin:read:all], owner: id}
+  # Admins must not write PII, whatever write scope they hold
+  - {effect: deny, method: PUT, path: /profiles/:id, scopes: [user:write:*]}
+  - {method: PUT, path: /profiles/:id, roles: [admin]}
+  # Suspended callers are denied everywhere
+  - {effect: deny, method: "*", path: "*", roles: [suspended]}
+  - {method: GET, path: /accounts, roles: [suspended, admin]}
+`
+	roles, _ := NewRoleRegistry(RoleConfig{Roles: map[string]RoleDefinition{
+		"user":      DefaultRoles.Roles["user"],
+		"admin":     DefaultRoles.Roles["admin"],
+		"suspended": {},
+	}})
+
+	admin := Subject{UserID: "admin1", Roles: []string{"admin"}}
+	user := Subject{UserID: "1", Roles: []string{"user"}}
+	suspended := Subject{UserID: "2", Roles: []string{"suspended"}}
+	readProfile := func(s Subject, id string) Request {
+		return Request{Method: "GET", Route: "/profiles/:id", Params: map[string]string{"id": id}, Subject: s}
+	}
+	writeProfile := Request{Method: "PUT", Route: "/profiles/:id", Params: map[string]string{"id": "1"}, Subject: admin}
+	listAccounts := Request{Method: "GET", Route: "/accounts", Subject: suspended}
+
+	tests := []struct {
+		name      string
+		algorithm string
+		req       Request
+		expected  bool
+	}{
+		// Deny by default: no applicable rule
+		{name: "no rule for the route", algorithm: DenyOverrides, req: Request{Method: "DELETE", Route: "/profiles/:id", Subject: admin}},
+		{name: "user reads another profile", algorithm: PermitOverrides, req: readProfile(user, "2")},
+		{name: "user reads own profile", algorithm: DenyOverrides, req: readProfile(user, "1"), expected: true},
+
+		// Most restrictive: admin:read:all and the self rule conflict
+		{name: "deny-overrides keeps admins out of profiles", algorithm: DenyOverrides, req: readProfile(admin, "1")},
+		{name: "permit-overrides lets admin:read:all win", algorithm: PermitOverrides, req: readProfile(admin, "1"), expected: true},
+		{name: "first-applicable takes the deny listed first", algorithm: FirstApplicable, req: readProfile(admin, "1")},
+
+		// Deny statements matched on scopes
+		{name: "deny-overrides blocks PII writes", algorithm: DenyOverrides, req: writeProfile},
+		{name: "permit-overrides allows PII writes", algorithm: PermitOverrides, req: writeProfile, expected: true},
+
+		// Wildcard deny rules
+		{name: "deny-overrides applies the global deny", algorithm: DenyOverrides, req: listAccounts},
+		{name: "first-applicable applies the global deny listed first", algorithm: FirstApplicable, req: listAccounts},
+		{name: "permit-overrides lets the route rule win", algorithm: PermitOverrides, req: listAccounts, expected: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			policy, err := ParsePolicy([]byte("algorithm: " + tt.algorithm + rules))
+			assert.NoError(t, err)
+			authorizer, err := NewAuthorizer(policy, roles, DefaultMatcher)
+			assert.NoError(t, err)
+
+			decision := authorizer.Authorize(tt.req)
+			assert.Equal(t, tt.expected, decision.Allowed, decision.Reason)
+			if !tt.expected && decision.Rule != nil {
+				assert.Equal(t, Deny, decision.Rule.Effect)
+			}
+		})
+	}
+}
+
+// Transactions over 10,000 are readable only by auditors during business hours
+func TestConditionsInPolicy(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+timezone: Asia/Bangkok
+rules:
+  - method: GET
+    path: /transactions/:id
+    roles: [user, auditor]
+  - effect: deny
+    method: GET
+    path: /transactions/:id
+    conditions:
+      - {attribute: resource.amount, operator: gt, value: 10000}
+      - {attribute: subject.roles, operator: not_contains, value: auditor}
+  - effect: deny
+    method: GET
+    path: /transactions/:id
+    conditions:
+      - {attribute: resource.amount, operator: gt, value: 10000}
+      - {attribute: request.time, operator: not_between, value: ["09:00", "17:00"]}
+`))
+	assert.NoError(t, err)
+	roles, _ := NewRoleRegistry(RoleConfig{Roles: map[string]RoleDefinition{
+		"user":    DefaultRoles.Roles["user"],
+		"auditor": {Scopes: []string{"transactions:read:all"}},
+	}})
+	authorizer, err := NewAuthorizer(policy, roles, DefaultMatcher)
+	assert.NoError(t, err)
+
+	bangkok, _ := time.LoadLocation("Asia/Bangkok")
+	office := time.Date(2024, 1, 3, 10, 0, 0, 0, bangkok)
+	night := time.Date(2024, 1, 3, 22, 0, 0, 0, bangkok)
+	auditor := Subject{UserID: "auditor1", Roles: []string{"auditor"}}
+	user := Subject{UserID: "user1", Roles: []string{"user"}}
+	small := map[string]interface{}{"amount": 500}
+	large := map[string]interface{}{"amount": 25000}
+
+	tests := []struct {
+		name     string
+		subject  Subject
+		resource map[string]interface{}
+		at       time.Time
+		expected bool
+	}{
+		{name: "user reads a small transaction", subject: user, resource: small, at: night, expected: true},
+		{name: "user cannot read a large transaction", subject: user, resource: large, at: office},
+		{name: "auditor reads a large transaction in office hours", subject: auditor, resource: large, at: office, expected: true},
+		{name: "auditor cannot read a large transaction at night", subject: auditor, resource: large, at: night},
+		{name: "deny rules fail closed without the resource", subject: auditor, at: office},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			decision := authorizer.Authorize(Request{
+				Method:   "GET",
+				Route:    "/transactions/:id",
+				Subject:  tt.subject,
+				Resource: tt.resource,
+				Time:     tt.at,
+			})
+			assert.Equal(t, tt.expected, decision.Allowed, decision.Reason)
+		})
+	}
+
+	_, err = NewAuthorizer(Policy{Timezone: "Mars/Olympus"}, roles, DefaultMatcher)
+	assert.Error(t, err)
+}
+
+func TestDecisionExplanation(t *testing.T) {
+	policy, err := ParsePolicy([]byte(`
+rules:
+  - method: PUT
+    path: /accounts/:id
+    scopes: [user:write:self]
+    owner: id
+  - method: GET
+    path: /transactions/:id
+    roles: [user]
+    conditions:
+      - {attribute: resource.amount, operator: lte, value: 10000}
+`))
+	assert.NoError(t, err)
+	authorizer, err := NewAuthorizer(policy, DefaultRoleRegistry, DefaultMatcher)
+	assert.NoError(t, err)
+
+	decision := authorizer.Authorize(Request{Method: "PUT", Route: "/accounts/:id", Params: map[string]string{"id": "1"}, Subject: Subject{UserID: "1", Scopes: []string{"user:read:self"}}})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "missing scope", decision.Reason)
+	assert.Equal(t, []string{"user:write:self"}, decision.MissingScopes)
+	assert.Equal(t, "PUT", decision.Candidate.Method)
+	assert.Nil(t, decision.Rule)
+
+	decision = authorizer.Authorize(Request{Method: "GET", Route: "/transactions/:id", Subject: Subject{UserID: "admin1", Roles: []string{"admin"}}, Resource: map[string]interface{}{"amount": 25000}})
+	assert.False(t, decision.Allowed)
+	assert.Equal(t, "resource.amount lte 10000", decision.FailedCondition)
+	assert.Equal(t, []string{"admin", "user"}, decision.Roles)
+	assert.NotEmpty(t, decision.Version)
+
+	decision = authorizer.Authorize(Request{Method: "GET", Route: "/transactions/:id", Subject: Subject{UserID: "user1", Roles: []string{"user"}}, Resource: map[string]interface{}{"amount": 500}})
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, "/transactions/:id", decision.Rule.Path)
+	assert.Empty(t, decision.Reason)
+}
@@ -0,0 +1,334 @@
+package authz
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// Tuple relates a subject to an object, written object#relation@subject. The
+// subject is an object, e.g. account:1#viewer@user:user2, or every subject
+// holding a relation on an object, e.g. account:1#owner@group:family#member.
+type Tuple struct {
+	Object   string
+	Relation string
+	Subject  string
+}
+
+// ParseTuple reads a tuple written as object#relation@subject
+func ParseTuple(s string) (Tuple, error) {
+	objectRelation, subject, ok := strings.Cut(s, "@")
+	object, relation, okRelation := strings.Cut(objectRelation, "#")
+	if !ok || !okRelation || !isObject(object) || relation == "" || !isSubject(subject) {
+		return Tuple{}, fmt.Errorf("invalid tuple %q: want type:id#relation@type:id or type:id#relation@type:id#relation", s)
+	}
+	return Tuple{Object: object, Relation: relation, Subject: subject}, nil
+}
+
+// MustParseTuple is ParseTuple for tuples known to be valid
+func MustParseTuple(s string) Tuple {
+	t, err := ParseTuple(s)
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+func (t Tuple) String() string {
+	return t.Object + "#" + t.Relation + "@" + t.Subject
+}
+
+func isObject(s string) bool {
+	typ, id, ok := strings.Cut(s, ":")
+	return ok && typ != "" && id != "" && !strings.ContainsAny(s, "#@")
+}
+
+func isSubject(s string) bool {
+	object, relation, ok := strings.Cut(s, "#")
+	return isObject(object) && (!ok || relation != "" && !strings.Contains(relation, "@"))
+}
+
+func objectType(object string) string {
+	typ, _, _ := strings.Cut(object, ":")
+	return typ
+}
+
+// RelationSchema lists the relations of every object type. A relation is held
+// through tuples naming it and through its rewrites: another relation of the
+// same object, e.g. viewer: [editor] makes every editor a viewer, or a
+// relation of the objects a tuple points to, e.g. viewer: [bank->admin] makes
+// the admins of the account's bank viewers.
+type RelationSchema map[string]map[string][]string
+
+// RelationConfig is the relation file, the schema and the tuples to start with
+//
+//	types:
+//	  group: {member: []}
+//	  account: {owner: [], viewer: [owner]}
+//	tuples:
+//	  - account:1#owner@user:user1
+//	  - account:1#viewer@group:family#member
+type RelationConfig struct {
+	Types  RelationSchema `json:"types" yaml:"types"`
+	Tuples []string       `json:"tuples,omitempty" yaml:"tuples,omitempty"`
+}
+
+// TupleStore holds relation tuples and answers checks against them. It is
+// safe for concurrent use.
+type TupleStore struct {
+	schema RelationSchema
+
+	// Roles adds the roles a caller inherits to the ones in its claims, so a
+	// role inheriting admin is a member of role:admin too. Nil uses the claims as given
+	Roles *RoleRegistry
+
+	// Debug returns every decision made by Require in the DecisionHeader
+	Debug bool
+
+	mu sync.RWMutex
+	// tuples maps object#relation to the subjects holding it
+	tuples map[string]map[string]bool
+}
+
+// NewTupleStore validates the schema, rewrites must name relations of their type
+func NewTupleStore(schema RelationSchema) (*TupleStore, error) {
+	// Sorted so errors are reported the same way on every run
+	types := make([]string, 0, len(schema))
+	for typ := range schema {
+		types = append(types, typ)
+	}
+	sort.Strings(types)
+
+	for _, typ := range types {
+		for relation, rewrites := range schema[typ] {
+			for _, rewrite := range rewrites {
+				tupleset, _, _ := strings.Cut(rewrite, "->")
+				if _, ok := schema[typ][tupleset]; !ok {
+					return nil, fmt.Errorf("relation %s#%s: %q names no relation of %s", typ, relation, rewrite, typ)
+				}
+			}
+		}
+	}
+	return &TupleStore{schema: schema, tuples: map[string]map[string]bool{}}, nil
+}
+
+// ParseRelations reads a RelationConfig from YAML and writes its tuples
+func ParseRelations(data []byte) (*TupleStore, error) {
+	var config RelationConfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+	s, err := NewTupleStore(config.Types)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range config.Tuples {
+		t, err := ParseTuple(line)
+		if err != nil {
+			return nil, err
+		}
+		if err := s.Write(t); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// LoadRelations reads a RelationConfig from a YAML file
+func LoadRelations(path string) (*TupleStore, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := ParseRelations(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// MustParseRelations is ParseRelations for the relations embedded in a program
+func MustParseRelations(data []byte) *TupleStore {
+	s, err := ParseRelations(data)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Write adds tuples, their object type and relation must be in the schema
+func (s *TupleStore) Write(tuples ...Tuple) error {
+	for _, t := range tuples {
+		if err := s.validate(t.Object, t.Relation); err != nil {
+			return fmt.Errorf("tuple %s: %w", t, err)
+		}
+		if userset, relation, ok := strings.Cut(t.Subject, "#"); ok {
+			if err := s.validate(userset, relation); err != nil {
+				return fmt.Errorf("tuple %s: %w", t, err)
+			}
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tuples {
+		key := t.Object + "#" + t.Relation
+		if s.tuples[key] == nil {
+			s.tuples[key] = map[string]bool{}
+		}
+		s.tuples[key][t.Subject] = true
+	}
+	return nil
+}
+
+// Delete removes tuples, missing ones are ignored
+func (s *TupleStore) Delete(tuples ...Tuple) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range tuples {
+		delete(s.tuples[t.Object+"#"+t.Relation], t.Subject)
+	}
+}
+
+// DeleteObject removes every tuple about object, e.g. when it is deleted
+func (s *TupleStore) DeleteObject(object string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for relation := range s.schema[objectType(object)] {
+		delete(s.tuples, object+"#"+relation)
+	}
+}
+
+func (s *TupleStore) validate(object, relation string) error {
+	relations, ok := s.schema[objectType(object)]
+	if !ok {
+		return fmt.Errorf("unknown object type %q", objectType(object))
+	}
+	if _, ok := relations[relation]; !ok {
+		return fmt.Errorf("unknown relation %q of %s", relation, objectType(object))
+	}
+	return nil
+}
+
+// Check reports whether subject holds relation on object, directly, through
+// group membership or through the relation's rewrites. contextual tuples hold
+// for this check only, e.g. the role memberships of the caller's token.
+func (s *TupleStore) Check(object, relation, subject string, contextual ...Tuple) (bool, error) {
+	if err := s.validate(object, relation); err != nil {
+		return false, err
+	}
+	extra := map[string][]string{}
+	for _, t := range contextual {
+		extra[t.Object+"#"+t.Relation] = append(extra[t.Object+"#"+t.Relation], t.Subject)
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.check(object, relation, subject, extra, map[string]bool{}), nil
+}
+
+func (s *TupleStore) check(object, relation, subject string, extra map[string][]string, visited map[string]bool) bool {
+	key := object + "#" + relation
+	// A userset reached twice is a nesting cycle, the first visit answers for it
+	if visited[key] {
+		return false
+	}
+	visited[key] = true
+
+	subjects := append([]string(nil), extra[key]...)
+	for held := range s.tuples[key] {
+		subjects = append(subjects, held)
+	}
+	for _, held := range subjects {
+		if held == subject {
+			return true
+		}
+		// group:family#member holds the relation for every member of the group
+		if userset, usersetRelation, ok := strings.Cut(held, "#"); ok {
+			if _, known := s.schema[objectType(userset)][usersetRelation]; known && s.check(userset, usersetRelation, subject, extra, visited) {
+				return true
+			}
+		}
+	}
+
+	for _, rewrite := range s.schema[objectType(object)][relation] {
+		tupleset, computed, ok := strings.Cut(rewrite, "->")
+		if !ok {
+			if s.check(object, rewrite, subject, extra, visited) {
+				return true
+			}
+			continue
+		}
+		for parent := range s.tuples[object+"#"+tupleset] {
+			if _, known := s.schema[objectType(parent)][computed]; known && s.check(parent, computed, subject, extra, visited) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ObjectFunc names the object a request acts on, e.g. account:1
+type ObjectFunc func(c *gin.Context) string
+
+// ObjectParam names the object of type typ whose id is in the path parameter param
+func ObjectParam(typ, param string) ObjectFunc {
+	return func(c *gin.Context) string {
+		return typ + ":" + c.Param(param)
+	}
+}
+
+// Decide checks relation on object for the caller. The caller is
+// user:<user_id>, and is a member of role:<role> for every role of the token
+// so tuples can grant a relation to a whole role.
+func (s *TupleStore) Decide(object, relation string, caller Subject) Decision {
+	user := "user:" + caller.UserID
+	roles := caller.Roles
+	if s.Roles != nil {
+		roles = s.Roles.Expand(roles...)
+	}
+	var memberships []Tuple
+	for _, role := range roles {
+		memberships = append(memberships, Tuple{Object: "role:" + role, Relation: "member", Subject: user})
+	}
+
+	decision := Decision{Relation: object + "#" + relation, Roles: roles}
+	allowed, err := s.Check(object, relation, user, memberships...)
+	switch {
+	case err != nil:
+		decision.Reason = err.Error()
+	case !allowed:
+		decision.Reason = fmt.Sprintf("%s is not %s of %s", user, relation, object)
+	}
+	decision.Allowed = allowed
+	return decision
+}
+
+// Require lets a request through when the caller holds relation on its object
+func (s *TupleStore) Require(relation string, object ObjectFunc, subject SubjectFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		caller, ok := subject(c)
+		if !ok {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "the claims do not exist"})
+			c.Abort()
+			return
+		}
+
+		decision := s.Decide(object(c), relation, caller)
+		if s.Debug {
+			setDecisionHeader(c, decision)
+		}
+		if !decision.Allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,160 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRelations = `
+types:
+  role: {member: []}
+  group: {member: []}
+  bank: {admin: []}
+  account:
+    bank: []
+    owner: [bank->admin]
+    editor: [owner]
+    viewer: [editor]
+tuples:
+  - bank:main#admin@role:admin#member
+  - account:1#bank@bank:main
+  - account:1#owner@user:user1
+  - account:1#owner@user:user4
+  - account:1#viewer@user:user2
+  - account:1#viewer@group:family#member
+  - group:family#member@user:user6
+  - group:family#member@group:kids#member
+  - group:kids#member@user:user7
+  - group:kids#member@group:family#member
+`
+
+func TestParseTuple(t *testing.T) {
+	for _, s := range []string{"account:1#viewer@user:user2", "account:1#owner@group:family#member"} {
+		tuple, err := ParseTuple(s)
+		assert.NoError(t, err)
+		assert.Equal(t, s, tuple.String())
+	}
+
+	for _, s := range []string{"", "account:1#viewer", "account:1@user:user2", "account#viewer@user:user2", "account:1#viewer@user", "account:1#@user:user2", "account:1#viewer@group:family#"} {
+		_, err := ParseTuple(s)
+		assert.Error(t, err, s)
+	}
+}
+
+func TestCheck(t *testing.T) {
+	s, err := ParseRelations([]byte(testRelations))
+	assert.NoError(t, err)
+
+	admin := MustParseTuple("role:admin#member@user:admin1")
+	tests := []struct {
+		name       string
+		relation   string
+		subject    string
+		contextual []Tuple
+		expected   bool
+	}{
+		{name: "owner", relation: "owner", subject: "user:user1", expected: true},
+		{name: "owners are viewers", relation: "viewer", subject: "user:user1", expected: true},
+		{name: "joint owner", relation: "editor", subject: "user:user4", expected: true},
+		{name: "delegated viewer", relation: "viewer", subject: "user:user2", expected: true},
+		{name: "viewers are not editors", relation: "editor", subject: "user:user2"},
+		{name: "household member", relation: "viewer", subject: "user:user6", expected: true},
+		{name: "nested group member", relation: "viewer", subject: "user:user7", expected: true},
+		{name: "stranger", relation: "viewer", subject: "user:user3"},
+		{name: "bank admin through a contextual role", relation: "owner", subject: "user:admin1", contextual: []Tuple{admin}, expected: true},
+		{name: "admin role only for its check", relation: "owner", subject: "user:admin1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := s.Check("account:1", tt.relation, tt.subject, tt.contextual...)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, allowed)
+		})
+	}
+
+	_, err = s.Check("account:1", "approver", "user:user1")
+	assert.Error(t, err)
+	_, err = s.Check("card:1", "owner", "user:user1")
+	assert.Error(t, err)
+}
+
+func TestTupleStoreWriteDelete(t *testing.T) {
+	s, _ := ParseRelations([]byte(testRelations))
+
+	assert.Error(t, s.Write(MustParseTuple("account:2#approver@user:user1")))
+	assert.Error(t, s.Write(MustParseTuple("account:2#viewer@team:ops#member")))
+
+	assert.NoError(t, s.Write(MustParseTuple("account:2#viewer@user:user3")))
+	allowed, _ := s.Check("account:2", "viewer", "user:user3")
+	assert.True(t, allowed)
+
+	s.Delete(MustParseTuple("account:2#viewer@user:user3"))
+	allowed, _ = s.Check("account:2", "viewer", "user:user3")
+	assert.False(t, allowed)
+
+	s.DeleteObject("account:1")
+	allowed, _ = s.Check("account:1", "viewer", "user:user1")
+	assert.False(t, allowed)
+}
+
+func TestNewTupleStoreErrors(t *testing.T) {
+	for _, schema := range []RelationSchema{
+		{"account": {"viewer": {"editor"}}},
+		{"account": {"viewer": {"parent->admin"}}},
+	} {
+		_, err := NewTupleStore(schema)
+		assert.Error(t, err)
+	}
+}
+
+func TestRequire(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _ := ParseRelations([]byte(testRelations))
+
+	tests := []struct {
+		name         string
+		subject      Subject
+		expectedCode int
+	}{
+		{name: "viewer", subject: Subject{UserID: "user2"}, expectedCode: http.StatusOK},
+		{name: "admin role", subject: Subject{UserID: "admin1", Roles: []string{"admin"}}, expectedCode: http.StatusOK},
+		{name: "stranger", subject: Subject{UserID: "user3", Roles: []string{"user"}}, expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			subject := func(c *gin.Context) (Subject, bool) { return tt.subject, true }
+			r.GET("/accounts/:id", s.Require("viewer", ObjectParam("account", "id"), subject), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/accounts/1", nil)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+// A role inheriting admin reaches the bank->admin path through the registry
+func TestDecideInheritedRoles(t *testing.T) {
+	s, _ := ParseRelations([]byte(testRelations))
+	caller := Subject{UserID: "ops1", Roles: []string{"operator"}}
+
+	assert.False(t, s.Decide("account:1", "owner", caller).Allowed)
+
+	s.Roles = MustRoleRegistry(RoleConfig{Roles: map[string]RoleDefinition{
+		"user":     {},
+		"admin":    {Inherits: []string{"user"}},
+		"operator": {Inherits: []string{"admin"}},
+	}})
+	decision := s.Decide("account:1", "owner", caller)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, []string{"admin", "operator", "user"}, decision.Roles)
+}
@@ -0,0 +1,82 @@
+package authz
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ResourceKey is the gin context key LoadResource stores the resource under
+const ResourceKey = "resource"
+
+// ErrNotFound is returned by a Loader when no resource has the id
+var ErrNotFound = errors.New("resource not found")
+
+// Loader fetches the resource with id, e.g. from a repository
+type Loader[T any] func(id string) (T, error)
+
+// IDFunc finds the id of the resource a request acts on, "" when it names
+// none. It may answer the request itself, e.g. when the body is malformed.
+type IDFunc func(c *gin.Context) string
+
+// IDParam finds the id in the path parameter param
+func IDParam(param string) IDFunc {
+	return func(c *gin.Context) string {
+		return c.Param(param)
+	}
+}
+
+// LoadResource fetches the resource whose id is in the path parameter param
+// and stores it under ResourceKey, so the policy and the handler see the
+// same resource. Install it in front of the policy Middleware: a missing
+// resource answers 404 with notFound before the policy or any handler runs.
+// Routes without param are passed through.
+func LoadResource[T any](param string, load Loader[T], notFound string) gin.HandlerFunc {
+	return LoadResourceBy(IDParam(param), load, notFound)
+}
+
+// LoadResourceBy is LoadResource for ids found by idOf, e.g. in the request body
+func LoadResourceBy[T any](idOf IDFunc, load Loader[T], notFound string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := idOf(c)
+		if c.IsAborted() {
+			return
+		}
+		if id == "" {
+			c.Next()
+			return
+		}
+
+		resource, err := load(id)
+		switch {
+		case errors.Is(err, ErrNotFound):
+			c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+			c.Abort()
+			return
+		case err != nil:
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			c.Abort()
+			return
+		}
+		c.Set(ResourceKey, resource)
+		c.Next()
+	}
+}
+
+// GetResource returns the resource LoadResource stored
+func GetResource[T any](c *gin.Context) (T, bool) {
+	return Get[T](c, ResourceKey)
+}
+
+// LoadedResource is the ResourceFunc exposing the resource LoadResource
+// stored to the policy, described by attributes
+func LoadedResource[T any](attributes func(resource T) map[string]interface{}) ResourceFunc {
+	return func(c *gin.Context) map[string]interface{} {
+		resource, ok := GetResource[T](c)
+		if !ok {
+			return nil
+		}
+		return attributes(resource)
+	}
+}
@@ -0,0 +1,137 @@
+package authz
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+type testAccount struct {
+	ID     string
+	UserID string
+}
+
+func TestLoadResource(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	store, err := NewPolicyStore([]byte(`
+rules:
+  - {method: GET, path: /accounts}
+  - {method: DELETE, path: /accounts/:id, scopes: [user:write:self], owner: resource.user_id}
+`), DefaultRoleRegistry, DefaultMatcher)
+	assert.NoError(t, err)
+
+	accounts := map[string]testAccount{"1": {ID: "1", UserID: "user1"}}
+	find := func(id string) (testAccount, error) {
+		if id == "broken" {
+			return testAccount{}, errors.New("database is down")
+		}
+		account, ok := accounts[id]
+		if !ok {
+			return testAccount{}, ErrNotFound
+		}
+		return account, nil
+	}
+	attributes := func(a testAccount) map[string]interface{} {
+		return map[string]interface{}{"id": a.ID, "user_id": a.UserID}
+	}
+
+	deleted := 0
+	r := gin.New()
+	r.Use(func(c *gin.Context) {
+		c.Set(ClaimsKey, &Claims{UserID: c.GetHeader("X-User"), Scopes: []string{"user:write:self"}})
+	}, LoadResource("id", find, "Account not found"), store.Middleware(ClaimsSubject, LoadedResource(attributes)))
+	r.GET("/accounts", func(c *gin.Context) {
+		_, ok := GetResource[testAccount](c)
+		assert.False(t, ok)
+		c.Status(http.StatusOK)
+	})
+	r.DELETE("/accounts/:id", func(c *gin.Context) {
+		account, ok := GetResource[testAccount](c)
+		assert.True(t, ok)
+		assert.Equal(t, "1", account.ID)
+		deleted++
+		c.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name         string
+		method       string
+		url          string
+		user         string
+		expectedCode int
+	}{
+		{name: "route without the parameter", method: http.MethodGet, url: "/accounts", user: "user2", expectedCode: http.StatusOK},
+		{name: "missing resource", method: http.MethodDelete, url: "/accounts/9", user: "user1", expectedCode: http.StatusNotFound},
+		{name: "loader error", method: http.MethodDelete, url: "/accounts/broken", user: "user1", expectedCode: http.StatusInternalServerError},
+		{name: "not the owner", method: http.MethodDelete, url: "/accounts/1", user: "user2", expectedCode: http.StatusForbidden},
+		{name: "owner", method: http.MethodDelete, url: "/accounts/1", user: "user1", expectedCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, nil)
+			req.Header.Set("X-User", tt.user)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+
+	// Only the owner's request reached the handler
+	assert.Equal(t, 1, deleted)
+}
+
+// An IDFunc can read the id from the body, and answer a malformed one itself
+func TestLoadResourceBy(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	fromBody := func(c *gin.Context) string {
+		var body struct {
+			From string `json:"from"`
+		}
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		}
+		return body.From
+	}
+	find := func(id string) (testAccount, error) {
+		if id != "1" {
+			return testAccount{}, ErrNotFound
+		}
+		return testAccount{ID: "1", UserID: "user1"}, nil
+	}
+
+	r := gin.New()
+	r.POST("/transfers", LoadResourceBy(fromBody, find, "Account not found"), func(c *gin.Context) {
+		account, ok := GetResource[testAccount](c)
+		c.JSON(http.StatusOK, gin.H{"loaded": ok, "id": account.ID})
+	})
+
+	tests := []struct {
+		name         string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "id in the body", body: `{"from":"1"}`, expectedCode: http.StatusOK, expectedBody: `{"id":"1","loaded":true}`},
+		{name: "no id", body: `{}`, expectedCode: http.StatusOK, expectedBody: `{"id":"","loaded":false}`},
+		{name: "missing resource", body: `{"from":"9"}`, expectedCode: http.StatusNotFound, expectedBody: `{"error":"Account not found"}`},
+		{name: "malformed body", body: `{`, expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/transfers", strings.NewReader(tt.body))
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+			if tt.expectedBody != "" {
+				assert.JSONEq(t, tt.expectedBody, w.Body.String())
+			}
+		})
+	}
+}
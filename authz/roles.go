@@ -0,0 +1,167 @@
+package authz
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+)
+
+// RoleDefinition is a role as written in the role config
+type RoleDefinition struct {
+	// Inherits names the roles whose scopes this role also grants
+	Inherits []string `json:"inherits,omitempty"`
+	Scopes   []string `json:"scopes"`
+}
+
+// RoleConfig is the role config file, e.g.
+//
+//	{"roles": {
+//	  "user":  {"scopes": ["user:read:self", "user:write:self"]},
+//	  "admin": {"inherits": ["user"], "scopes": ["admin:read:all", "admin:write:all"]}
+//	}}
+type RoleConfig struct {
+	Roles map[string]RoleDefinition `json:"roles"`
+}
+
+// DefaultRoles lets admin inherit everything user can do
+var DefaultRoles = RoleConfig{Roles: map[string]RoleDefinition{
+	"user":  {Scopes: []string{"user:read:self", "user:write:self"}},
+	"admin": {Inherits: []string{"user"}, Scopes: []string{"admin:read:all", "admin:write:all"}},
+}}
+
+// RoleRegistry maps roles to the scopes they grant. Inheritance is resolved
+// once when the registry is built, it is read only afterwards and safe for
+// concurrent use.
+type RoleRegistry struct {
+	scopes    map[string][]Scope
+	ancestors map[string]map[string]bool
+}
+
+// DefaultRoleRegistry is built from DefaultRoles
+var DefaultRoleRegistry = MustRoleRegistry(DefaultRoles)
+
+// NewRoleRegistry resolves the inheritance of every role. Scopes must be well
+// formed, inherited roles must exist and inheritance must not be cyclic.
+func NewRoleRegistry(config RoleConfig) (*RoleRegistry, error) {
+	r := &RoleRegistry{scopes: map[string][]Scope{}, ancestors: map[string]map[string]bool{}}
+
+	// Sorted so errors are reported the same way on every run
+	names := make([]string, 0, len(config.Roles))
+	for name := range config.Roles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if _, err := r.resolve(config, name, map[string]bool{}); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+func (r *RoleRegistry) resolve(config RoleConfig, name string, visiting map[string]bool) (map[string]bool, error) {
+	if ancestors, ok := r.ancestors[name]; ok {
+		return ancestors, nil
+	}
+	def, ok := config.Roles[name]
+	if !ok {
+		return nil, fmt.Errorf("role %q: not defined", name)
+	}
+	if visiting[name] {
+		return nil, fmt.Errorf("role %q: inheritance cycle", name)
+	}
+	visiting[name] = true
+
+	ancestors := map[string]bool{}
+	var scopes []Scope
+	for _, s := range def.Scopes {
+		scope, err := ParseScope(s)
+		if err != nil {
+			return nil, fmt.Errorf("role %q: %w", name, err)
+		}
+		scopes = append(scopes, scope)
+	}
+	for _, parent := range def.Inherits {
+		parentAncestors, err := r.resolve(config, parent, visiting)
+		if err != nil {
+			return nil, fmt.Errorf("role %q: %w", name, err)
+		}
+		ancestors[parent] = true
+		for a := range parentAncestors {
+			ancestors[a] = true
+		}
+		scopes = append(scopes, r.scopes[parent]...)
+	}
+
+	r.scopes[name] = scopes
+	r.ancestors[name] = ancestors
+	return ancestors, nil
+}
+
+// MustRoleRegistry is NewRoleRegistry for roles shipped with the program, it panics on error
+func MustRoleRegistry(config RoleConfig) *RoleRegistry {
+	r, err := NewRoleRegistry(config)
+	if err != nil {
+		panic(err)
+	}
+	return r
+}
+
+// LoadRoleRegistry reads a RoleConfig from a JSON file
+func LoadRoleRegistry(path string) (*RoleRegistry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config RoleConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewRoleRegistry(config)
+}
+
+// RoleRegistryFromEnv loads the file named by ROLES_FILE, or returns defaults when it is not set
+func RoleRegistryFromEnv(defaults *RoleRegistry) (*RoleRegistry, error) {
+	path := os.Getenv("ROLES_FILE")
+	if path == "" {
+		return defaults, nil
+	}
+	return LoadRoleRegistry(path)
+}
+
+// Scopes returns the scopes granted by the roles, inherited ones included.
+// Unknown roles grant nothing.
+func (r *RoleRegistry) Scopes(roles ...string) []Scope {
+	var scopes []Scope
+	for _, role := range roles {
+		scopes = append(scopes, r.scopes[role]...)
+	}
+	return scopes
+}
+
+// Is reports whether role is allowed or inherits it, directly or not
+func (r *RoleRegistry) Is(role, allowed string) bool {
+	if role == allowed {
+		return true
+	}
+	return r.ancestors[role][allowed]
+}
+
+// Expand returns the roles and every role they inherit, sorted
+func (r *RoleRegistry) Expand(roles ...string) []string {
+	seen := map[string]bool{}
+	for _, role := range roles {
+		seen[role] = true
+		for ancestor := range r.ancestors[role] {
+			seen[ancestor] = true
+		}
+	}
+	expanded := make([]string, 0, len(seen))
+	for role := range seen {
+		expanded = append(expanded, role)
+	}
+	sort.Strings(expanded)
+	return expanded
+}
@@ -0,0 +1,77 @@
+package authz
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoleRegistryInheritance(t *testing.T) {
+	registry, err := NewRoleRegistry(RoleConfig{Roles: map[string]RoleDefinition{
+		"viewer":  {Scopes: []string{"accounts:read:self"}},
+		"user":    {Inherits: []string{"viewer"}, Scopes: []string{"accounts:write:self"}},
+		"auditor": {Inherits: []string{"viewer"}, Scopes: []string{"accounts:read:all"}},
+		"admin":   {Inherits: []string{"user", "auditor"}, Scopes: []string{"admin:write:all"}},
+	}})
+	assert.NoError(t, err)
+
+	scopes := func(roles ...string) []string {
+		var s []string
+		for _, scope := range registry.Scopes(roles...) {
+			s = append(s, scope.String())
+		}
+		return s
+	}
+
+	assert.ElementsMatch(t, []string{"accounts:read:self"}, scopes("viewer"))
+	assert.ElementsMatch(t, []string{"accounts:write:self", "accounts:read:self"}, scopes("user"))
+	assert.Subset(t, scopes("admin"), []string{"admin:write:all", "accounts:write:self", "accounts:read:all", "accounts:read:self"})
+	assert.Empty(t, scopes("unknown"))
+
+	assert.True(t, registry.Is("admin", "admin"))
+	assert.True(t, registry.Is("admin", "viewer"))
+	assert.False(t, registry.Is("user", "admin"))
+	assert.False(t, registry.Is("unknown", "user"))
+}
+
+func TestRoleRegistryErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		roles map[string]RoleDefinition
+	}{
+		{name: "malformed scope", roles: map[string]RoleDefinition{"user": {Scopes: []string{"user:read"}}}},
+		{name: "unknown parent", roles: map[string]RoleDefinition{"admin": {Inherits: []string{"user"}}}},
+		{name: "cycle", roles: map[string]RoleDefinition{
+			"a": {Inherits: []string{"b"}},
+			"b": {Inherits: []string{"a"}},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewRoleRegistry(RoleConfig{Roles: tt.roles})
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadRoleRegistry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "roles.json")
+	os.WriteFile(path, []byte(`{"roles": {
+		"user": {"scopes": ["user:read:self"]},
+		"admin": {"inherits": ["user"], "scopes": ["admin:read:all"]}
+	}}`), 0o600)
+
+	t.Setenv("ROLES_FILE", path)
+	registry, err := RoleRegistryFromEnv(DefaultRoleRegistry)
+	assert.NoError(t, err)
+	assert.Len(t, registry.Scopes("admin"), 2)
+
+	t.Setenv("ROLES_FILE", "")
+	registry, err = RoleRegistryFromEnv(DefaultRoleRegistry)
+	assert.NoError(t, err)
+	assert.Same(t, DefaultRoleRegistry, registry)
+	assert.Len(t, registry.Scopes("admin"), 4)
+}
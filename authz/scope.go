@@ -0,0 +1,174 @@
+package authz
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Qualifiers restrict which resources a scope covers
+const (
+	// Self covers only resources owned by the caller
+	Self = "self"
+	// All covers every resource
+	All = "all"
+	// Wildcard in a granted scope matches any resource, action or qualifier
+	Wildcard = "*"
+)
+
+// Scope is a permission of the form resource:action:qualifier, e.g. user:read:self
+type Scope struct {
+	Resource  string
+	Action    string
+	Qualifier string
+}
+
+// ParseScope parses resource:action:qualifier. The qualifier may be written
+// as a placeholder, user:read:{self} is the same as user:read:self. Any part
+// may be the * wildcard, e.g. accounts:*:all or *:read:self.
+func ParseScope(s string) (Scope, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 3 {
+		return Scope{}, fmt.Errorf("scope %q: expected resource:action:qualifier", s)
+	}
+	scope := Scope{
+		Resource:  parts[0],
+		Action:    parts[1],
+		Qualifier: strings.TrimSuffix(strings.TrimPrefix(parts[2], "{"), "}"),
+	}
+	if scope.Resource == "" || scope.Action == "" {
+		return Scope{}, fmt.Errorf("scope %q: resource and action are required", s)
+	}
+	if scope.Qualifier != Self && scope.Qualifier != All && scope.Qualifier != Wildcard {
+		return Scope{}, fmt.Errorf("scope %q: qualifier must be %s, %s or %s", s, Self, All, Wildcard)
+	}
+	return scope, nil
+}
+
+// MustParseScope is ParseScope for scopes known at compile time, it panics on error
+func MustParseScope(s string) Scope {
+	scope, err := ParseScope(s)
+	if err != nil {
+		panic(err)
+	}
+	return scope
+}
+
+// ParseScopes parses every scope, skipping the ones that are not well formed.
+// Granted scopes come from tokens, where a malformed entry must not fail the request.
+func ParseScopes(scopes []string) []Scope {
+	parsed := make([]Scope, 0, len(scopes))
+	for _, s := range scopes {
+		if scope, err := ParseScope(s); err == nil {
+			parsed = append(parsed, scope)
+		}
+	}
+	return parsed
+}
+
+func (s Scope) String() string {
+	return s.Resource + ":" + s.Action + ":" + s.Qualifier
+}
+
+// Hierarchy lists the actions each action implies, e.g. write implies read.
+// Implications are transitive.
+type Hierarchy map[string][]string
+
+// DefaultHierarchy lets write imply read
+var DefaultHierarchy = Hierarchy{"write": {"read"}}
+
+// Matcher decides whether granted scopes satisfy a required scope. It is
+// compiled once from a Hierarchy and is safe for concurrent use.
+type Matcher struct {
+	implied map[string]map[string]bool
+}
+
+// DefaultMatcher matches with DefaultHierarchy
+var DefaultMatcher = NewMatcher(DefaultHierarchy)
+
+// NewMatcher compiles the transitive closure of the hierarchy
+func NewMatcher(h Hierarchy) *Matcher {
+	m := &Matcher{implied: map[string]map[string]bool{}}
+	for action := range h {
+		closure := map[string]bool{}
+		var visit func(string)
+		visit = func(a string) {
+			for _, next := range h[a] {
+				if !closure[next] {
+					closure[next] = true
+					visit(next)
+				}
+			}
+		}
+		visit(action)
+		m.implied[action] = closure
+	}
+	return m
+}
+
+// Match reports whether granted satisfies required.
+//
+//   - A * resource or action in granted matches any resource or action
+//   - A granted action satisfies the actions it implies
+//   - A granted all or * qualifier covers every resource
+//   - A granted self qualifier only covers self requirements, and only when
+//     isOwner reports the caller owns the resource. A nil isOwner leaves
+//     ownership to the caller, so a matching self scope is enough.
+func (m *Matcher) Match(granted, required Scope, isOwner func() bool) bool {
+	if granted.Resource != Wildcard && granted.Resource != required.Resource {
+		return false
+	}
+	if granted.Action != Wildcard && granted.Action != required.Action && !m.implied[granted.Action][required.Action] {
+		return false
+	}
+	switch granted.Qualifier {
+	case All, Wildcard:
+		return true
+	case Self:
+		return required.Qualifier == Self && (isOwner == nil || isOwner())
+	default:
+		return false
+	}
+}
+
+// MatchAny returns the first required scope satisfied by any granted scope.
+// isOwner is consulted at most once.
+func (m *Matcher) MatchAny(granted []Scope, required []Scope, isOwner func() bool) (Scope, bool) {
+	if isOwner != nil {
+		var owner, checked bool
+		check := isOwner
+		isOwner = func() bool {
+			if !checked {
+				owner, checked = check(), true
+			}
+			return owner
+		}
+	}
+	for _, r := range required {
+		for _, g := range granted {
+			if m.Match(g, r, isOwner) {
+				return r, true
+			}
+		}
+	}
+	return Scope{}, false
+}
+
+// Covers reports whether holding scope falls under pattern, reading * as any
+// value. Holding an action also holds the actions it implies and all also holds
+// self, so the pattern user:read:self covers user:write:all.
+func (m *Matcher) Covers(pattern, scope Scope) bool {
+	if pattern.Resource != Wildcard && scope.Resource != Wildcard && pattern.Resource != scope.Resource {
+		return false
+	}
+	if pattern.Action != Wildcard && scope.Action != Wildcard && pattern.Action != scope.Action && !m.implied[scope.Action][pattern.Action] {
+		return false
+	}
+	switch pattern.Qualifier {
+	case Wildcard, scope.Qualifier:
+		return true
+	case Self:
+		return scope.Qualifier == All || scope.Qualifier == Wildcard
+	default:
+		return scope.Qualifier == Wildcard
+	}
+}
@@ -0,0 +1,130 @@
+package authz
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseScope(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected Scope
+		wantErr  bool
+	}{
+		{input: "user:read:self", expected: Scope{Resource: "user", Action: "read", Qualifier: Self}},
+		{input: "admin:read:{all}", expected: Scope{Resource: "admin", Action: "read", Qualifier: All}},
+		{input: "accounts:*:*", expected: Scope{Resource: "accounts", Action: Wildcard, Qualifier: Wildcard}},
+		{input: "user:read", wantErr: true},
+		{input: "user:read:mine", wantErr: true},
+		{input: ":read:self", wantErr: true},
+		{input: "a:b:c:d", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			scope, err := ParseScope(tt.input)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, scope)
+		})
+	}
+
+	assert.Equal(t, "admin:read:all", MustParseScope("admin:read:{all}").String())
+	assert.Len(t, ParseScopes([]string{"user:read:self", "garbage"}), 1)
+}
+
+func TestMatcher(t *testing.T) {
+	owner := func() bool { return true }
+	stranger := func() bool { return false }
+
+	// Which granted scopes satisfy which required scopes
+	tests := []struct {
+		granted  string
+		required string
+		isOwner  func() bool
+		expected bool
+	}{
+		// self and all
+		{granted: "user:read:self", required: "user:read:self", isOwner: owner, expected: true},
+		{granted: "user:read:self", required: "user:read:self", isOwner: stranger},
+		{granted: "user:read:self", required: "user:read:self", isOwner: nil, expected: true},
+		{granted: "admin:read:all", required: "admin:read:all", isOwner: stranger, expected: true},
+		{granted: "user:read:all", required: "user:read:self", isOwner: stranger, expected: true},
+		{granted: "user:read:self", required: "user:read:all", isOwner: owner},
+		{granted: "user:read:self", required: "user:write:self", isOwner: owner},
+		{granted: "admin:read:all", required: "user:read:self", isOwner: owner},
+
+		// wildcards
+		{granted: "accounts:*:all", required: "accounts:read:self", isOwner: stranger, expected: true},
+		{granted: "accounts:*:all", required: "accounts:delete:all", isOwner: stranger, expected: true},
+		{granted: "accounts:*:all", required: "profiles:read:all", isOwner: stranger},
+		{granted: "*:read:self", required: "accounts:read:self", isOwner: owner, expected: true},
+		{granted: "*:read:self", required: "profiles:read:self", isOwner: stranger},
+		{granted: "*:read:self", required: "accounts:write:self", isOwner: owner},
+		{granted: "profiles:write:*", required: "profiles:write:all", isOwner: stranger, expected: true},
+		{granted: "*:*:*", required: "admin:write:all", isOwner: stranger, expected: true},
+
+		// hierarchy: write implies read
+		{granted: "accounts:write:self", required: "accounts:read:self", isOwner: owner, expected: true},
+		{granted: "accounts:write:self", required: "accounts:read:self", isOwner: stranger},
+		{granted: "accounts:write:all", required: "accounts:read:self", isOwner: stranger, expected: true},
+		{granted: "accounts:read:all", required: "accounts:write:self", isOwner: owner},
+	}
+
+	for _, tt := range tests {
+		name := tt.granted + " satisfies " + tt.required
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, DefaultMatcher.Match(MustParseScope(tt.granted), MustParseScope(tt.required), tt.isOwner))
+		})
+	}
+}
+
+func TestTransitiveHierarchy(t *testing.T) {
+	matcher := NewMatcher(Hierarchy{"admin": {"write"}, "write": {"read"}, "read": {"admin"}})
+
+	assert.True(t, matcher.Match(MustParseScope("accounts:admin:all"), MustParseScope("accounts:read:all"), nil))
+	assert.True(t, matcher.Match(MustParseScope("accounts:read:all"), MustParseScope("accounts:write:all"), nil), "cycles are followed without looping")
+	assert.False(t, DefaultMatcher.Match(MustParseScope("accounts:admin:all"), MustParseScope("accounts:read:all"), nil))
+}
+
+func TestMatchAny(t *testing.T) {
+	granted := ParseScopes([]string{"user:read:self"})
+	required := []Scope{MustParseScope("admin:read:all"), MustParseScope("user:read:self")}
+
+	calls := 0
+	isOwner := func() bool { calls++; return true }
+	matched, ok := DefaultMatcher.MatchAny(granted, required, isOwner)
+	assert.True(t, ok)
+	assert.Equal(t, "user:read:self", matched.String())
+	assert.Equal(t, 1, calls)
+
+	_, ok = DefaultMatcher.MatchAny(granted, required, func() bool { return false })
+	assert.False(t, ok)
+}
+
+func TestCovers(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		held     string
+		expected bool
+	}{
+		{pattern: "user:write:*", held: "user:write:self", expected: true},
+		{pattern: "user:write:*", held: "user:write:all", expected: true},
+		{pattern: "user:write:*", held: "user:read:all"},
+		{pattern: "user:read:self", held: "user:write:all", expected: true},
+		{pattern: "user:read:all", held: "user:read:self"},
+		{pattern: "*:*:all", held: "admin:read:all", expected: true},
+		{pattern: "profiles:write:all", held: "*:*:*", expected: true},
+		{pattern: "profiles:write:all", held: "accounts:write:all"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" covers "+tt.held, func(t *testing.T) {
+			assert.Equal(t, tt.expected, DefaultMatcher.Covers(MustParseScope(tt.pattern), MustParseScope(tt.held)))
+		})
+	}
+}
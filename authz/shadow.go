@@ -0,0 +1,116 @@
+package authz
+
+import (
+	"log"
+	"sync"
+)
+
+// Shadow evaluates a candidate policy next to the one in force on every
+// request, logging and counting where they disagree. The candidate never
+// decides a request, so a stricter policy can be tried on live traffic before
+// it is switched on. Only policy decisions are compared, relation checks
+// made by a TupleStore are not shadowed.
+type Shadow struct {
+	// Candidate is the policy being tried, it can be watched and updated like the one in force
+	Candidate *PolicyStore
+	// LogDisagreement is called when the candidate decides a request differently
+	LogDisagreement func(req Request, enforced, candidate Decision)
+
+	mu    sync.Mutex
+	stats ShadowStats
+}
+
+// ShadowStats counts the requests a Shadow compared against one candidate
+// version, since it was created or reset
+type ShadowStats struct {
+	Evaluated int64 `json:"evaluated"`
+	// WouldDeny counts requests allowed now that the candidate would deny
+	WouldDeny int64 `json:"would_deny"`
+	// WouldAllow counts requests denied now that the candidate would allow
+	WouldAllow int64 `json:"would_allow"`
+	// Routes breaks the disagreements down by METHOD route
+	Routes map[string]*ShadowRouteStats `json:"routes,omitempty"`
+	// CandidateVersion is the version of the candidate policy in force
+	CandidateVersion string `json:"candidate_version"`
+}
+
+// ShadowRouteStats counts the disagreements on one route
+type ShadowRouteStats struct {
+	WouldDeny  int64 `json:"would_deny"`
+	WouldAllow int64 `json:"would_allow"`
+}
+
+// NewShadow tries candidate next to the policy in force, logging disagreements
+func NewShadow(candidate *PolicyStore) *Shadow {
+	return &Shadow{Candidate: candidate, LogDisagreement: logDisagreement}
+}
+
+// Compare evaluates the candidate policy for a request the policy in force decided
+func (s *Shadow) Compare(req Request, enforced Decision) Decision {
+	candidate := s.Candidate.Authorizer().Authorize(req)
+
+	s.mu.Lock()
+	// Counts made against an earlier candidate say nothing about this one
+	if s.stats.CandidateVersion != candidate.Version {
+		s.stats = ShadowStats{CandidateVersion: candidate.Version}
+	}
+	s.stats.Evaluated++
+	if candidate.Allowed != enforced.Allowed {
+		route := routeKey(req.Method, req.Route)
+		if s.stats.Routes == nil {
+			s.stats.Routes = map[string]*ShadowRouteStats{}
+		}
+		if s.stats.Routes[route] == nil {
+			s.stats.Routes[route] = &ShadowRouteStats{}
+		}
+		if enforced.Allowed {
+			s.stats.WouldDeny++
+			s.stats.Routes[route].WouldDeny++
+		} else {
+			s.stats.WouldAllow++
+			s.stats.Routes[route].WouldAllow++
+		}
+	}
+	s.mu.Unlock()
+
+	if candidate.Allowed != enforced.Allowed && s.LogDisagreement != nil {
+		s.LogDisagreement(req, enforced, candidate)
+	}
+	return candidate
+}
+
+// Stats returns a copy of the counts
+func (s *Shadow) Stats() ShadowStats {
+	version := s.Candidate.Authorizer().Version()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stats.CandidateVersion != version {
+		return ShadowStats{Routes: map[string]*ShadowRouteStats{}, CandidateVersion: version}
+	}
+	stats := s.stats
+	stats.Routes = make(map[string]*ShadowRouteStats, len(s.stats.Routes))
+	for route, counts := range s.stats.Routes {
+		copied := *counts
+		stats.Routes[route] = &copied
+	}
+	return stats
+}
+
+// Reset clears the counts. They are also cleared when the candidate changes
+func (s *Shadow) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.stats = ShadowStats{}
+}
+
+func logDisagreement(req Request, enforced, candidate Decision) {
+	effect := func(d Decision) string {
+		if d.Allowed {
+			return "allow"
+		}
+		return "deny"
+	}
+	log.Printf("authz shadow %s %s user=%q enforced=%s candidate=%s policy=%s candidate_policy=%s reason=%q",
+		req.Method, req.Route, req.Subject.UserID, effect(enforced), effect(candidate), enforced.Version, candidate.Version, candidate.Reason)
+}
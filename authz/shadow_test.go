@@ -0,0 +1,79 @@
+package authz
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadow(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	enforced := MustPolicyStore([]byte(`
+rules:
+  - {method: GET, path: /accounts, roles: [user, admin]}
+  - {method: GET, path: /profiles, roles: [admin]}
+`), DefaultRoleRegistry, DefaultMatcher)
+	candidate := MustPolicyStore([]byte(`
+rules:
+  - {method: GET, path: /accounts, roles: [admin]}
+  - {method: GET, path: /profiles, roles: [user, admin]}
+`), DefaultRoleRegistry, DefaultMatcher)
+
+	var disagreements []string
+	enforced.Shadow = NewShadow(candidate)
+	enforced.Shadow.LogDisagreement = func(req Request, enforced, candidate Decision) {
+		disagreements = append(disagreements, req.Route)
+	}
+
+	r := gin.New()
+	role := "user"
+	r.Use(enforced.Middleware(func(c *gin.Context) (Subject, bool) {
+		return Subject{UserID: "1", Roles: []string{role}}, true
+	}, nil))
+	r.GET("/accounts", func(c *gin.Context) { c.Status(http.StatusOK) })
+	r.GET("/profiles", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, path, nil)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// The policy in force still decides
+	assert.Equal(t, http.StatusOK, get("/accounts"))
+	assert.Equal(t, http.StatusForbidden, get("/profiles"))
+	role = "admin"
+	assert.Equal(t, http.StatusOK, get("/accounts"))
+
+	stats := enforced.Shadow.Stats()
+	assert.Equal(t, int64(3), stats.Evaluated)
+	assert.Equal(t, int64(1), stats.WouldDeny)
+	assert.Equal(t, int64(1), stats.WouldAllow)
+	assert.Equal(t, &ShadowRouteStats{WouldDeny: 1}, stats.Routes["GET /accounts"])
+	assert.Equal(t, &ShadowRouteStats{WouldAllow: 1}, stats.Routes["GET /profiles"])
+	assert.Equal(t, candidate.Authorizer().Version(), stats.CandidateVersion)
+	assert.Equal(t, []string{"/accounts", "/profiles"}, disagreements)
+
+	enforced.Shadow.Reset()
+	assert.Equal(t, int64(0), enforced.Shadow.Stats().Evaluated)
+
+	// Counts start over for a new candidate
+	get("/accounts")
+	updated, err := candidate.Update([]byte(`
+rules:
+  - {method: GET, path: /accounts, roles: [user, admin]}
+`))
+	assert.NoError(t, err)
+	stats = enforced.Shadow.Stats()
+	assert.Equal(t, int64(0), stats.Evaluated)
+	assert.Equal(t, updated.Version(), stats.CandidateVersion)
+
+	get("/accounts")
+	stats = enforced.Shadow.Stats()
+	assert.Equal(t, int64(1), stats.Evaluated)
+	assert.Equal(t, int64(0), stats.WouldDeny)
+}
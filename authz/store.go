@@ -0,0 +1,228 @@
+package authz
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrVersionMismatch is returned by UpdateIf when the policy changed in the meantime
+var ErrVersionMismatch = errors.New("policy version mismatch")
+
+type policyVersion struct {
+	authorizer *Authorizer
+	source     []byte
+}
+
+// PolicyStore holds the policy in force and replaces it at runtime. A new
+// policy is validated before it is swapped in, so a broken one leaves the last
+// good version in force. Each request evaluates a single version.
+type PolicyStore struct {
+	roles   *RoleRegistry
+	matcher *Matcher
+
+	current atomic.Pointer[policyVersion]
+	// mu serializes updates, reads go through current without locking
+	mu sync.Mutex
+
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	// LogDecision, when set, is called with every decision made by Middleware,
+	// e.g. PrintDecision
+	LogDecision func(req Request, decision Decision)
+	// Logf, when set, receives what Watch reloads or rejects, e.g. log.Printf
+	Logf func(format string, args ...interface{})
+	// Debug returns every decision made by Middleware in the DecisionHeader
+	Debug bool
+	// Shadow, when set, tries a candidate policy on every request Middleware decides
+	Shadow *Shadow
+}
+
+// NewPolicyStore compiles the initial policy
+func NewPolicyStore(data []byte, roles *RoleRegistry, matcher *Matcher) (*PolicyStore, error) {
+	s := &PolicyStore{roles: roles, matcher: matcher, stop: make(chan struct{})}
+	if _, err := s.Update(data); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// MustPolicyStore is NewPolicyStore for policies shipped with the program, it panics on error
+func MustPolicyStore(data []byte, roles *RoleRegistry, matcher *Matcher) *PolicyStore {
+	s, err := NewPolicyStore(data, roles, matcher)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// Authorizer returns the policy in force
+func (s *PolicyStore) Authorizer() *Authorizer {
+	return s.current.Load().authorizer
+}
+
+// Source returns the policy document in force and its version
+func (s *PolicyStore) Source() ([]byte, string) {
+	current := s.current.Load()
+	return current.source, current.authorizer.Version()
+}
+
+// Update parses, validates and swaps in a new policy. On error the policy in force is kept.
+func (s *PolicyStore) Update(data []byte) (*Authorizer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.update(data)
+}
+
+// UpdateIf is Update only when version is still the version in force,
+// otherwise it returns ErrVersionMismatch
+func (s *PolicyStore) UpdateIf(version string, data []byte) (*Authorizer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if current := s.current.Load(); current != nil && current.authorizer.Version() != version {
+		return nil, ErrVersionMismatch
+	}
+	return s.update(data)
+}
+
+func (s *PolicyStore) update(data []byte) (*Authorizer, error) {
+	policy, err := ParsePolicy(data)
+	if err != nil {
+		return nil, err
+	}
+	authorizer, err := NewAuthorizer(policy, s.roles, s.matcher)
+	if err != nil {
+		return nil, err
+	}
+	s.current.Store(&policyVersion{authorizer: authorizer, source: data})
+	return authorizer, nil
+}
+
+// Watch reloads the policy file whenever its content changes, checking every
+// interval. Set Logf before calling it.
+func (s *PolicyStore) Watch(path string, interval time.Duration) {
+	last, _ := os.ReadFile(path)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				data, err := os.ReadFile(path)
+				if err != nil || bytes.Equal(data, last) {
+					continue
+				}
+				last = data
+				if err := s.reload(path, data); err != nil {
+					s.logf("Policy reload failed, keeping the last good version: %v", err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (s *PolicyStore) reload(path string, data []byte) error {
+	authorizer, err := s.Update(data)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	s.logf("Policy reloaded, version %s", authorizer.Version())
+	return nil
+}
+
+func (s *PolicyStore) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// Stop ends the watch started by Watch
+func (s *PolicyStore) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// PrintDecision logs a decision with the standard logger, set it as
+// LogDecision to log every request
+func PrintDecision(req Request, decision Decision) {
+	effect := "deny"
+	if decision.Allowed {
+		effect = "allow"
+	}
+	log.Printf("authz %s %s %s user=%q policy=%s reason=%q", effect, req.Method, req.Route, req.Subject.UserID, decision.Version, decision.Reason)
+}
+
+// LogDecisionsFromEnv reads whether every decision is logged from
+// AUTHZ_LOG_DECISIONS, off by default
+func LogDecisionsFromEnv() (bool, error) {
+	value := os.Getenv("AUTHZ_LOG_DECISIONS")
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// ReloadIntervalFromEnv reads how often Watch checks the policy file from
+// POLICY_RELOAD_INTERVAL, a Go duration, ten seconds by default
+func ReloadIntervalFromEnv() (time.Duration, error) {
+	value := os.Getenv("POLICY_RELOAD_INTERVAL")
+	if value == "" {
+		return 10 * time.Second, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if interval <= 0 {
+		return 0, fmt.Errorf("POLICY_RELOAD_INTERVAL must be positive")
+	}
+	return interval, nil
+}
+
+// DebugFromEnv reads whether decisions are returned in the DecisionHeader
+// from AUTHZ_DEBUG, off by default
+func DebugFromEnv() (bool, error) {
+	value := os.Getenv("AUTHZ_DEBUG")
+	if value == "" {
+		return false, nil
+	}
+	return strconv.ParseBool(value)
+}
+
+// PolicyStoreFromEnv compiles the file named by POLICY_FILE, or defaults when it is not set
+func PolicyStoreFromEnv(defaults []byte, roles *RoleRegistry, matcher *Matcher) (*PolicyStore, error) {
+	data := defaults
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		var err error
+		if data, err = os.ReadFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return NewPolicyStore(data, roles, matcher)
+}
+
+// ShadowFromEnv compiles the file named by SHADOW_POLICY_FILE as a candidate
+// tried next to the policy in force, nil when it is not set
+func ShadowFromEnv(roles *RoleRegistry, matcher *Matcher) (*Shadow, error) {
+	path := os.Getenv("SHADOW_POLICY_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	candidate, err := NewPolicyStore(data, roles, matcher)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return NewShadow(candidate), nil
+}
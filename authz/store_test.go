@@ -0,0 +1,108 @@
+package authz
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPolicyStoreUpdate(t *testing.T) {
+	store, err := NewPolicyStore([]byte(testPolicy), DefaultRoleRegistry, DefaultMatcher)
+	assert.NoError(t, err)
+	first := store.Authorizer().Version()
+
+	listAccounts := Request{Method: "GET", Route: "/accounts", Subject: Subject{Roles: []string{"user"}}}
+	assert.False(t, store.Authorizer().Authorize(listAccounts).Allowed)
+
+	// A broken policy keeps the last good version
+	_, err = store.Update([]byte(`rules: [{method: GET, path: /accounts, roles: [root]}]`))
+	assert.Error(t, err)
+	assert.Equal(t, first, store.Authorizer().Version())
+
+	updated, err := store.Update([]byte(`rules: [{method: GET, path: /accounts, roles: [user]}]`))
+	assert.NoError(t, err)
+	assert.NotEqual(t, first, updated.Version())
+	decision := store.Authorizer().Authorize(listAccounts)
+	assert.True(t, decision.Allowed)
+	assert.Equal(t, updated.Version(), decision.Version)
+
+	// Only the rules make the version, not the formatting
+	reformatted, err := store.Update([]byte("# comment\nrules:\n  - method: GET\n    path: /accounts\n    roles: [user]\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, updated.Version(), reformatted.Version())
+	source, version := store.Source()
+	assert.Contains(t, string(source), "# comment")
+	assert.Equal(t, updated.Version(), version)
+}
+
+func TestPolicyStoreUpdateIf(t *testing.T) {
+	store, _ := NewPolicyStore([]byte(testPolicy), DefaultRoleRegistry, DefaultMatcher)
+	version := store.Authorizer().Version()
+
+	_, err := store.UpdateIf("stale", []byte(`rules: []`))
+	assert.ErrorIs(t, err, ErrVersionMismatch)
+	assert.Equal(t, version, store.Authorizer().Version())
+
+	_, err = store.UpdateIf(version, []byte(`rules: []`))
+	assert.NoError(t, err)
+	assert.NotEqual(t, version, store.Authorizer().Version())
+}
+
+func TestPolicyStoreWatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "policy.yaml")
+	os.WriteFile(path, []byte(testPolicy), 0o600)
+
+	store, _ := NewPolicyStore([]byte(testPolicy), DefaultRoleRegistry, DefaultMatcher)
+	assert.Nil(t, store.LogDecision, "decisions are only logged on request")
+	messages := make(chan string, 10)
+	store.Logf = func(format string, args ...interface{}) { messages <- fmt.Sprintf(format, args...) }
+	store.Watch(path, 10*time.Millisecond)
+	defer store.Stop()
+	first := store.Authorizer().Version()
+
+	os.WriteFile(path, []byte(`rules: [{method: GET, path: /accounts, roles: [root]}]`), 0o600)
+	assert.Contains(t, receive(t, messages), "Policy reload failed")
+	assert.Equal(t, first, store.Authorizer().Version(), "an invalid file keeps the last good version")
+
+	os.WriteFile(path, []byte(`rules: [{method: GET, path: /accounts, roles: [user]}]`), 0o600)
+	assert.Contains(t, receive(t, messages), "Policy reloaded, version")
+	assert.NotEqual(t, first, store.Authorizer().Version())
+}
+
+func TestPolicyStoreConcurrentReads(t *testing.T) {
+	store, _ := NewPolicyStore([]byte(testPolicy), DefaultRoleRegistry, DefaultMatcher)
+	policies := [][]byte{[]byte(testPolicy), []byte(`rules: [{method: GET, path: /accounts, roles: [user]}]`)}
+	req := Request{Method: "GET", Route: "/accounts", Subject: Subject{Roles: []string{"admin"}}}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				assert.True(t, store.Authorizer().Authorize(req).Allowed)
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		store.Update(policies[i%2])
+	}
+	wg.Wait()
+}
+
+// receive waits a second for the next log message
+func receive(t *testing.T, messages <-chan string) string {
+	t.Helper()
+	select {
+	case message := <-messages:
+		return message
+	case <-time.After(time.Second):
+		t.Fatal("no log message")
+		return ""
+	}
+}
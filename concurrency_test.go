@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// Many users create, rename, read and delete their accounts at once while
+// others read a shared one, run it with -race
+func TestConcurrentAccounts(t *testing.T) {
+	r := setupRouter()
+	const users = 32
+
+	do := func(method, url, token string, body interface{}) *httptest.ResponseRecorder {
+		var payload []byte
+		if body != nil {
+			payload, _ = json.Marshal(body)
+		}
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, url, bytes.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]string, users)
+	for i := 0; i < users; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			userID := fmt.Sprintf("stress%d", i)
+			token := generateMockJWT(userID, []string{"user:read:self", "user:write:self"})
+
+			w := do(http.MethodPost, "/accounts", token, repository.Account{UserID: userID, Name: "New"})
+			if !assert.Equal(t, http.StatusCreated, w.Code, w.Body.String()) {
+				return
+			}
+			var account repository.Account
+			json.Unmarshal(w.Body.Bytes(), &account)
+			ids[i] = account.ID
+
+			url := "/accounts/" + account.ID
+			assert.Equal(t, http.StatusOK, do(http.MethodPut, url, token, repository.Account{Name: userID}).Code)
+			w = do(http.MethodGet, url, token, nil)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Contains(t, w.Body.String(), `"name":"`+userID+`"`)
+
+			// Every other user deletes the account again
+			if i%2 == 0 {
+				assert.Equal(t, http.StatusOK, do(http.MethodDelete, url, token, nil).Code)
+				assert.Equal(t, http.StatusNotFound, do(http.MethodGet, url, token, nil).Code)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			token := generateMockJWT("user3", []string{"user:read:self"})
+			assert.Equal(t, http.StatusOK, do(http.MethodGet, "/accounts/3", token, nil).Code)
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, id := range ids {
+		assert.False(t, seen[id], "id %s was handed out twice", id)
+		seen[id] = true
+	}
+}
+
+// Two users racing to change and delete the same account end in one of the
+// orders, never in a half-applied one
+func TestConcurrentUpdateAndDelete(t *testing.T) {
+	for round := 0; round < 20; round++ {
+		s := newMemoryServer()
+		r := s.router()
+		token := generateMockJWT("user1", []string{"user:read:self", "user:write:self"})
+
+		codes := make(chan int, 2)
+		var wg sync.WaitGroup
+		for _, method := range []string{http.MethodPut, http.MethodDelete} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				w := httptest.NewRecorder()
+				req, _ := http.NewRequest(method, "/accounts/1", bytes.NewReader([]byte(`{"name":"Renamed"}`)))
+				req.Header.Set("Authorization", "Bearer "+token)
+				r.ServeHTTP(w, req)
+				codes <- w.Code
+			}()
+		}
+		wg.Wait()
+		close(codes)
+
+		for code := range codes {
+			assert.Contains(t, []int{http.StatusOK, http.StatusNotFound}, code)
+		}
+		_, err := s.accounts.Get("1")
+		assert.ErrorIs(t, err, repository.ErrNotFound)
+		allowed, _ := s.relations.Check("account:1", "viewer", "user:user1")
+		assert.False(t, allowed)
+	}
+}
@@ -0,0 +1,254 @@
+// Package conformance runs the access control scenarios documented in the
+// README against a server, so the document and the code cannot drift apart.
+package conformance
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scenario is one row of the scenario table
+type Scenario struct {
+	Name   string
+	Method string
+	// Path is the requested URL, e.g. /api/v1/accounts/2
+	Path string
+	// Role, Scope, UserID and Owner are empty for N/A
+	Role   string
+	Scope  string
+	UserID string
+	// Owner is the user id owning the requested resource
+	Owner string
+	Code  int
+}
+
+// columns are the headers the table must have, other columns are ignored
+var columns = []string{"Test Case Name", "Client Request", "Role", "Scope", "User ID (Claim)", "Resource Owner ID", "Response Code"}
+
+// Load reads the first markdown table with a Client Request column from a
+// file. Scenario names must be unique and every row needs a request and a
+// response code.
+func Load(path string) ([]Scenario, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var header map[string]int
+	width := 0
+	var scenarios []Scenario
+	seen := map[string]int{}
+	line := 0
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if !strings.HasPrefix(text, "|") {
+			if header != nil {
+				break
+			}
+			continue
+		}
+		cells := splitRow(text)
+
+		switch {
+		case header == nil:
+			header, width = indexOf(cells), len(cells)
+			continue
+		case strings.Trim(strings.Join(cells, ""), "-: ") == "":
+			continue
+		}
+
+		if len(cells) != width {
+			return nil, fmt.Errorf("%s:%d: %d cells, the header has %d", path, line, len(cells), width)
+		}
+		s, err := parseRow(cells, header)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		if first, ok := seen[s.Name]; ok {
+			return nil, fmt.Errorf("%s:%d: %q is already listed on line %d", path, line, s.Name, first)
+		}
+		seen[s.Name] = line
+		scenarios = append(scenarios, s)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("%s: no scenario table", path)
+	}
+	return scenarios, nil
+}
+
+// splitRow returns the cells of a table row without markdown emphasis and code spans
+func splitRow(row string) []string {
+	cells := strings.Split(strings.Trim(row, "|"), "|")
+	for i, cell := range cells {
+		cell = strings.ReplaceAll(cell, "**", "")
+		cells[i] = strings.TrimSpace(strings.ReplaceAll(cell, "`", ""))
+	}
+	return cells
+}
+
+// indexOf maps the columns to their position, nil when the row is not a scenario table header
+func indexOf(cells []string) map[string]int {
+	index := map[string]int{}
+	for i, cell := range cells {
+		index[cell] = i
+	}
+	for _, column := range columns {
+		if _, ok := index[column]; !ok {
+			return nil
+		}
+	}
+	return index
+}
+
+func parseRow(cells []string, header map[string]int) (Scenario, error) {
+	cell := func(column string) string {
+		value := cells[header[column]]
+		if value == "N/A" {
+			return ""
+		}
+		return value
+	}
+
+	s := Scenario{
+		Name:   cell("Test Case Name"),
+		Role:   cell("Role"),
+		Scope:  cell("Scope"),
+		UserID: cell("User ID (Claim)"),
+		Owner:  cell("Resource Owner ID"),
+	}
+	var ok bool
+	if s.Method, s.Path, ok = strings.Cut(cell("Client Request"), " "); !ok || s.Name == "" {
+		return s, fmt.Errorf("want a name and a request such as GET /api/v1/accounts")
+	}
+	// 403 Forbidden
+	code, _, _ := strings.Cut(cell("Response Code"), " ")
+	var err error
+	if s.Code, err = strconv.Atoi(code); err != nil {
+		return s, fmt.Errorf("%s: response code %q is not a number", s.Name, cell("Response Code"))
+	}
+	return s, nil
+}
+
+// Program adapts one server to the scenarios
+type Program struct {
+	Router *gin.Engine
+	// Path maps a scenario's URL to the program's, nil keeps it
+	Path func(path string) string
+	// Token signs a token with the scenario's role, scope and user id
+	Token func(s Scenario) string
+	// Own makes owner own the resource with id on route and returns a func undoing it
+	Own func(route, id, owner string) func()
+	// Skip names the scenarios the program does not conform to, because it
+	// does not serve the route or knowingly answers it otherwise
+	Skip []string
+}
+
+// Run runs every scenario as a subtest, reporting each mismatch. Only the
+// scenarios in Skip are skipped: any other unserved route fails, so a renamed
+// route or a mistyped path in the README is not silently ignored. A skipped
+// scenario on a served route is still sent, and fails once the program
+// answers it as the README says, so Skip does not outlive the difference.
+func Run(t *testing.T, program Program, scenarios []Scenario) {
+	if err := checkSkip(program.Skip, scenarios); err != nil {
+		t.Error(err)
+	}
+	skip := map[string]bool{}
+	for _, name := range program.Skip {
+		skip[name] = true
+	}
+
+	for _, s := range scenarios {
+		t.Run(s.Name, func(t *testing.T) {
+			path := s.Path
+			if program.Path != nil {
+				path = program.Path(path)
+			}
+			route, params, ok := match(program.Router.Routes(), s.Method, path)
+			switch {
+			case !ok && skip[s.Name]:
+				t.Skipf("%s %s is not served by this program", s.Method, path)
+			case !ok:
+				t.Fatalf("%s %s is not served by this program, fix the route or add the scenario to Program.Skip", s.Method, path)
+			}
+			if id, ok := params["id"]; ok && s.Owner != "" && program.Own != nil {
+				defer program.Own(route, id, s.Owner)()
+			}
+
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(s.Method, path, strings.NewReader("{}"))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Authorization", "Bearer "+program.Token(s))
+			program.Router.ServeHTTP(w, req)
+
+			switch {
+			case skip[s.Name] && w.Code == s.Code:
+				t.Errorf("%s %s answers %d as the README says, remove the scenario from Program.Skip", s.Method, path, w.Code)
+			case skip[s.Name]:
+				t.Skipf("%s %s answers %d, the README says %d", s.Method, path, w.Code, s.Code)
+			case w.Code != s.Code:
+				t.Errorf("%s %s as %s (role %q, scope %q) on a resource of %q: got %d, the README says %d: %s",
+					s.Method, path, s.UserID, s.Role, s.Scope, s.Owner, w.Code, s.Code, w.Body.String())
+			}
+		})
+	}
+}
+
+// checkSkip reports the skipped scenario names that are not in scenarios
+func checkSkip(skip []string, scenarios []Scenario) error {
+	names := map[string]bool{}
+	for _, s := range scenarios {
+		names[s.Name] = true
+	}
+	var unknown []string
+	for _, name := range skip {
+		if !names[name] {
+			unknown = append(unknown, strconv.Quote(name))
+		}
+	}
+	if len(unknown) > 0 {
+		return fmt.Errorf("Program.Skip lists unknown scenarios %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// match finds the registered route serving a request and its path parameters
+func match(routes gin.RoutesInfo, method, path string) (string, map[string]string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	for _, route := range routes {
+		if route.Method != method {
+			continue
+		}
+		segments := strings.Split(strings.Trim(route.Path, "/"), "/")
+		if len(segments) != len(parts) {
+			continue
+		}
+		params := map[string]string{}
+		matched := true
+		for i, segment := range segments {
+			switch {
+			case strings.HasPrefix(segment, ":"):
+				params[segment[1:]] = parts[i]
+			case segment != parts[i]:
+				matched = false
+			}
+		}
+		if matched {
+			return route.Path, params, true
+		}
+	}
+	return "", nil, false
+}
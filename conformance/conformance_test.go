@@ -0,0 +1,78 @@
+package conformance
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+const header = `# Scenarios
+
+| **Test Case Name** | **Client Request** | **Role** | **Scope** | **User ID (Claim)** | **Resource Owner ID** | **Response Code** | **Explanation** |
+| --- | --- | --- | --- | --- | --- | --- | --- |
+`
+
+func write(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "README.md")
+	assert.NoError(t, os.WriteFile(path, []byte(content), 0o600))
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := write(t, header+
+		"| **Scenario 1** | `GET /api/v1/accounts` | `user` | N/A | `user1` | N/A | `403 Forbidden` | admin only |\n"+
+		"| **Scenario 2** | `PUT /api/v1/profiles/1` | `admin` | `admin:write:all` | `admin1` | `user1` | `200 OK` | |\n"+
+		"\nThe table ends here\n| not | a | scenario |\n")
+
+	scenarios, err := Load(path)
+	assert.NoError(t, err)
+	assert.Equal(t, []Scenario{
+		{Name: "Scenario 1", Method: "GET", Path: "/api/v1/accounts", Role: "user", UserID: "user1", Code: 403},
+		{Name: "Scenario 2", Method: "PUT", Path: "/api/v1/profiles/1", Role: "admin", Scope: "admin:write:all", UserID: "admin1", Owner: "user1", Code: 200},
+	}, scenarios)
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]string{
+		"duplicate name": header +
+			"| Scenario 1 | GET /a | user | N/A | user1 | N/A | 403 Forbidden | |\n" +
+			"| Scenario 1 | GET /a | admin | N/A | admin1 | N/A | 200 OK | |\n",
+		"missing cell":        header + "| Scenario 1 | GET /a | user | N/A | user1 | N/A | 403 Forbidden |\n",
+		"request":             header + "| Scenario 1 | /a | user | N/A | user1 | N/A | 403 Forbidden | |\n",
+		"response code":       header + "| Scenario 1 | GET /a | user | N/A | user1 | N/A | Forbidden | |\n",
+		"no scenario table":   "| a | b |\n| - | - |\n",
+		"missing column name": "| Test Case Name | Client Request |\n| - | - |\n",
+	}
+
+	for name, content := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Load(write(t, content))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestMatch(t *testing.T) {
+	routes := gin.RoutesInfo{{Method: "GET", Path: "/accounts"}, {Method: "GET", Path: "/accounts/:id"}}
+
+	route, params, ok := match(routes, "GET", "/accounts/2")
+	assert.True(t, ok)
+	assert.Equal(t, "/accounts/:id", route)
+	assert.Equal(t, map[string]string{"id": "2"}, params)
+
+	_, _, ok = match(routes, "PUT", "/accounts/2")
+	assert.False(t, ok)
+	_, _, ok = match(routes, "GET", "/profiles/2")
+	assert.False(t, ok)
+}
+
+func TestCheckSkip(t *testing.T) {
+	scenarios := []Scenario{{Name: "Scenario 1"}, {Name: "Scenario 2"}}
+
+	assert.NoError(t, checkSkip(nil, scenarios))
+	assert.NoError(t, checkSkip([]string{"Scenario 2"}, scenarios))
+	assert.EqualError(t, checkSkip([]string{"Scenario 2", "Scenario 3"}, scenarios), `Program.Skip lists unknown scenarios "Scenario 3"`)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/conformance"
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// The README scenarios for the account routes this server has, without the /api/v1 prefix
+func TestConformance(t *testing.T) {
+	scenarios, err := conformance.Load("README.md")
+	assert.NoError(t, err)
+
+	s := newMemoryServer()
+	conformance.Run(t, conformance.Program{
+		Router: s.router(),
+		Path:   func(path string) string { return strings.TrimPrefix(path, "/api/v1") },
+		Token: func(scenario conformance.Scenario) string {
+			var roles, scopes []string
+			if scenario.Role != "" {
+				roles = []string{scenario.Role}
+			}
+			if scenario.Scope != "" {
+				scopes = []string{scenario.Scope}
+			}
+			token, _ := generateJWT(scenario.UserID, roles, scopes)
+			return token
+		},
+		Own:  s.ownAccount,
+		Skip: unserved,
+	}, scenarios)
+}
+
+// unserved are the README scenarios for routes this server does not have: it
+// lists no accounts and has no profiles
+var unserved = []string{
+	"Scenario 1: User Access to Admin-Only Endpoint",
+	"Scenario 2: Admin Access to Admin-Only Endpoint",
+	"Scenario 3: User Access to Admin-Only Profile Endpoint",
+	"Scenario 4: Admin Access to Admin-Only Profile Endpoint",
+	"Scenario 9: User Access to Profile with user:read:self Scope",
+	"Scenario 10: User Access to Another User's Profile with user:read:self Scope",
+	"Scenario 11: Admin Access to Profile with user:read:self Scope",
+	"Scenario 12: User Access to Profile with user:write:self Scope",
+	"Scenario 13: User Access to Another User's Profile with user:write:self Scope",
+	"Scenario 14: Admin Access to Own Profile with user:write:self Scope",
+	"Scenario 15: Admin Access to Another User's Profile with user:write:self Scope",
+	"Scenario 16: Admin Access to Profile with admin:write:all Scope",
+}
+
+// ownAccount makes owner the owner of the account, creating it when it does not exist
+func (s *server) ownAccount(route, id, owner string) func() {
+	object := "account:" + id
+	ownerTuple := func(userID string) authz.Tuple {
+		return authz.Tuple{Object: object, Relation: "owner", Subject: "user:" + userID}
+	}
+
+	account, err := s.accounts.Get(id)
+	if err != nil {
+		account = repository.Account{ID: id, UserID: owner, Name: "Account " + id}
+		s.accounts.Create(account)
+		s.relateAccount(account)
+		return func() {
+			s.accounts.Delete(id)
+			s.relations.DeleteObject(object)
+		}
+	}
+
+	previous := account.UserID
+	if previous == owner {
+		return func() {}
+	}
+	account.UserID = owner
+	s.accounts.Update(account)
+	s.relations.Delete(ownerTuple(previous))
+	s.relations.Write(ownerTuple(owner))
+	return func() {
+		account.UserID = previous
+		s.accounts.Update(account)
+		s.relations.Delete(ownerTuple(owner))
+		s.relations.Write(ownerTuple(previous))
+	}
+}
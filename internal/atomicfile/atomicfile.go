@@ -0,0 +1,28 @@
+// Package atomicfile replaces files so readers and restarts never see a
+// partly written one
+package atomicfile
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// WriteFile replaces the file at path with data. data goes to a temporary
+// file in the same directory first, which is then renamed over path, so a
+// crash leaves either the old content or the new one. The file is created
+// readable by its owner only.
+func WriteFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,154 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"slices"
+
+	"github.com/anuchito/poc-api-permission/internal/atomicfile"
+)
+
+// File keeps records in memory and writes them to a JSON file on every
+// change, so they survive restarts. A change that cannot be written is undone.
+type File[T any] struct {
+	*Memory[T]
+	path string
+}
+
+// fileContent is what a File saves, the last id is kept so ids of deleted
+// records are not handed out again after a restart
+type fileContent[T any] struct {
+	LastID  uint64 `json:"last_id"`
+	Records []T    `json:"records"`
+}
+
+// NewFile loads the records saved at path. A missing file holds seed, it is
+// written on the first change. id and prefix are as for NewMemory.
+func NewFile[T any](path string, id func(record *T) *string, prefix string, seed ...T) (*File[T], error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return &File[T]{Memory: NewMemory(id, prefix, seed...), path: path}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var content fileContent[T]
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, err
+	}
+	m := NewMemory(id, prefix, content.Records...)
+	m.last = max(m.last, content.LastID)
+	return &File[T]{Memory: m, path: path}, nil
+}
+
+// NewFileAccounts creates an AccountRepository saved at path
+func NewFileAccounts(path string, seed ...Account) (*File[Account], error) {
+	return NewFile(path, accountID, "", seed...)
+}
+
+// NewFileProfiles creates a ProfileRepository saved at path
+func NewFileProfiles(path string, seed ...Profile) (*File[Profile], error) {
+	return NewFile(path, profileID, "", seed...)
+}
+
+// FileTransactions keeps transactions in a JSON file
+type FileTransactions struct {
+	*File[Transaction]
+}
+
+// NewFileTransactions creates a TransactionRepository saved at path
+func NewFileTransactions(path string, seed ...Transaction) (*FileTransactions, error) {
+	f, err := NewFile(path, transactionID, "tx", seed...)
+	if err != nil {
+		return nil, err
+	}
+	return &FileTransactions{f}, nil
+}
+
+// Create implements Repository
+func (f *File[T]) Create(record T) (T, error) {
+	var created T
+	err := f.change(func() (undo func(), err error) {
+		created, err = f.create(record)
+		return func() { f.remove(*f.id(&created)) }, err
+	})
+	return created, err
+}
+
+// Update implements Repository
+func (f *File[T]) Update(record T) error {
+	return f.change(func() (func(), error) {
+		id := *f.id(&record)
+		previous := f.records[id]
+		return func() { f.records[id] = previous }, f.update(record)
+	})
+}
+
+// Delete implements Repository
+func (f *File[T]) Delete(id string) error {
+	return f.change(func() (func(), error) {
+		record, index := f.records[id], slices.Index(f.order, id)
+		return func() {
+			f.records[id] = record
+			f.order = slices.Insert(f.order, index, id)
+		}, f.remove(id)
+	})
+}
+
+// change applies a change and saves it while holding the write lock, so
+// nobody reads a record that is not saved and writes reach the file in
+// order. apply returns the inverse of its change, which is run when the
+// change cannot be saved.
+func (f *File[T]) change(apply func() (undo func(), err error)) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	last := f.last
+	undo, err := apply()
+	if err != nil {
+		return err
+	}
+	if err := f.save(); err != nil {
+		undo()
+		f.last = last
+		return err
+	}
+	return nil
+}
+
+// save writes the records, the caller holds the lock
+func (f *File[T]) save() error {
+	content := fileContent[T]{LastID: f.last, Records: make([]T, 0, len(f.order))}
+	for _, id := range f.order {
+		content.Records = append(content.Records, f.records[id])
+	}
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+	return atomicfile.WriteFile(f.path, data)
+}
+
+// ListByAccount implements TransactionRepository
+func (f *FileTransactions) ListByAccount(accountID string) ([]Transaction, error) {
+	return f.filter(func(t Transaction) bool { return t.AccountID == accountID }), nil
+}
+
+// Transfer implements TransactionRepository, both transactions are saved in one write
+func (f *FileTransactions) Transfer(debit, credit Transaction) (Transaction, Transaction, error) {
+	var created []Transaction
+	err := f.change(func() (undo func(), err error) {
+		created, err = f.createAll(debit, credit)
+		return func() {
+			for _, record := range created {
+				f.remove(record.ID)
+			}
+		}, err
+	})
+	if err != nil {
+		return Transaction{}, Transaction{}, err
+	}
+	return created[0], created[1], nil
+}
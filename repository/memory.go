@@ -0,0 +1,188 @@
+package repository
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Memory keeps records in memory. It is safe for concurrent use.
+type Memory[T any] struct {
+	// id points to the id field of a record
+	id func(record *T) *string
+	// prefix starts every generated id, e.g. tx for tx1, tx2
+	prefix string
+
+	mu      sync.RWMutex
+	records map[string]T
+	// order lists the ids in the order the records were created
+	order []string
+	// last is the highest id number handed out or seen
+	last uint64
+}
+
+// NewMemory creates a repository holding seed. id points to the id field of
+// a record, generated ids are prefix followed by a number.
+func NewMemory[T any](id func(record *T) *string, prefix string, seed ...T) *Memory[T] {
+	m := &Memory[T]{id: id, prefix: prefix, records: map[string]T{}}
+	for _, record := range seed {
+		key := *id(&record)
+		m.records[key] = record
+		m.order = append(m.order, key)
+		m.observe(key)
+	}
+	return m
+}
+
+// NewMemoryAccounts creates an AccountRepository holding seed
+func NewMemoryAccounts(seed ...Account) *Memory[Account] {
+	return NewMemory(accountID, "", seed...)
+}
+
+// NewMemoryProfiles creates a ProfileRepository holding seed
+func NewMemoryProfiles(seed ...Profile) *Memory[Profile] {
+	return NewMemory(profileID, "", seed...)
+}
+
+// MemoryTransactions keeps transactions in memory
+type MemoryTransactions struct {
+	*Memory[Transaction]
+}
+
+// NewMemoryTransactions creates a TransactionRepository holding seed
+func NewMemoryTransactions(seed ...Transaction) *MemoryTransactions {
+	return &MemoryTransactions{NewMemory(transactionID, "tx", seed...)}
+}
+
+// List implements Repository
+func (m *Memory[T]) List() ([]T, error) {
+	return m.filter(func(T) bool { return true }), nil
+}
+
+// Get implements Repository
+func (m *Memory[T]) Get(id string) (T, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	record, ok := m.records[id]
+	if !ok {
+		return record, ErrNotFound
+	}
+	return record, nil
+}
+
+// Create implements Repository
+func (m *Memory[T]) Create(record T) (T, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.create(record)
+}
+
+// Update implements Repository
+func (m *Memory[T]) Update(record T) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.update(record)
+}
+
+// Delete implements Repository
+func (m *Memory[T]) Delete(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.remove(id)
+}
+
+// create, update and remove change the records, the caller holds the write lock
+func (m *Memory[T]) create(record T) (T, error) {
+	id := m.id(&record)
+	if *id == "" {
+		m.last++
+		*id = m.prefix + strconv.FormatUint(m.last, 10)
+	}
+	if _, ok := m.records[*id]; ok {
+		var zero T
+		return zero, ErrExists
+	}
+	m.records[*id] = record
+	m.order = append(m.order, *id)
+	m.observe(*id)
+	return record, nil
+}
+
+func (m *Memory[T]) update(record T) error {
+	id := *m.id(&record)
+	if _, ok := m.records[id]; !ok {
+		return ErrNotFound
+	}
+	m.records[id] = record
+	return nil
+}
+
+func (m *Memory[T]) remove(id string) error {
+	if _, ok := m.records[id]; !ok {
+		return ErrNotFound
+	}
+	delete(m.records, id)
+	for i, ordered := range m.order {
+		if ordered == id {
+			m.order = append(m.order[:i], m.order[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+// createAll creates every record or, when one fails, none. The caller holds
+// the write lock.
+func (m *Memory[T]) createAll(records ...T) ([]T, error) {
+	created := make([]T, 0, len(records))
+	for _, record := range records {
+		record, err := m.create(record)
+		if err != nil {
+			for _, undo := range created {
+				m.remove(*m.id(&undo))
+			}
+			return nil, err
+		}
+		created = append(created, record)
+	}
+	return created, nil
+}
+
+// observe keeps generated ids above the ones given explicitly, e.g. by the seed
+func (m *Memory[T]) observe(id string) {
+	rest, ok := strings.CutPrefix(id, m.prefix)
+	if !ok {
+		return
+	}
+	if n, err := strconv.ParseUint(rest, 10, 64); err == nil && n > m.last {
+		m.last = n
+	}
+}
+
+func (m *Memory[T]) filter(keep func(record T) bool) []T {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	records := make([]T, 0, len(m.order))
+	for _, id := range m.order {
+		if record := m.records[id]; keep(record) {
+			records = append(records, record)
+		}
+	}
+	return records
+}
+
+// ListByAccount implements TransactionRepository
+func (m *MemoryTransactions) ListByAccount(accountID string) ([]Transaction, error) {
+	return m.filter(func(t Transaction) bool { return t.AccountID == accountID }), nil
+}
+
+// Transfer implements TransactionRepository
+func (m *MemoryTransactions) Transfer(debit, credit Transaction) (Transaction, Transaction, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	created, err := m.createAll(debit, credit)
+	if err != nil {
+		return Transaction{}, Transaction{}, err
+	}
+	return created[0], created[1], nil
+}
@@ -0,0 +1,76 @@
+// Package repository stores the accounts, profiles and transactions the
+// servers serve, in memory or in JSON files.
+package repository
+
+import (
+	"errors"
+
+	"github.com/anuchito/poc-api-permission/authz"
+)
+
+// ErrNotFound is returned for an id no record has. It is authz.ErrNotFound,
+// so a repository's Get is an authz.Loader.
+var ErrNotFound = authz.ErrNotFound
+
+// ErrExists is returned by Create for an id a record already has
+var ErrExists = errors.New("record already exists")
+
+// Account belongs to the user in UserID
+type Account struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// Profile belongs to the user in UserID
+type Profile struct {
+	ID     string `json:"id"`
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+}
+
+// Transaction moves Amount in or out of an account
+type Transaction struct {
+	ID        string  `json:"id"`
+	AccountID string  `json:"account_id"`
+	Amount    float64 `json:"amount"`
+	CreatedAt string  `json:"created_at"`
+	// TransferID links the debit and the credit of a transfer
+	TransferID string `json:"transfer_id,omitempty"`
+}
+
+// Repository stores records of one kind by id. List returns them in the
+// order they were created. Implementations are safe for concurrent use.
+type Repository[T any] interface {
+	List() ([]T, error)
+	Get(id string) (T, error)
+	// Create adds a record and returns it. A record without an id gets the
+	// next one, ids are never handed out twice, not even after a deletion.
+	Create(record T) (T, error)
+	// Update replaces the record with the same id
+	Update(record T) error
+	Delete(id string) error
+}
+
+// AccountRepository stores accounts
+type AccountRepository interface {
+	Repository[Account]
+}
+
+// ProfileRepository stores profiles
+type ProfileRepository interface {
+	Repository[Profile]
+}
+
+// TransactionRepository stores transactions
+type TransactionRepository interface {
+	Repository[Transaction]
+	// ListByAccount returns the transactions of an account in the order they were created
+	ListByAccount(accountID string) ([]Transaction, error)
+	// Transfer records the debit and the credit of a transfer, both or neither
+	Transfer(debit, credit Transaction) (Transaction, Transaction, error)
+}
+
+func accountID(a *Account) *string         { return &a.ID }
+func profileID(p *Profile) *string         { return &p.ID }
+func transactionID(t *Transaction) *string { return &t.ID }
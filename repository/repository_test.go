@@ -0,0 +1,207 @@
+package repository
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemory(t *testing.T) {
+	repo := NewMemoryAccounts(Account{ID: "1", UserID: "user1", Name: "Account 1"})
+
+	_, err := repo.Create(Account{ID: "2", UserID: "user2", Name: "Account 2"})
+	assert.NoError(t, err)
+	_, err = repo.Create(Account{ID: "1"})
+	assert.ErrorIs(t, err, ErrExists)
+
+	account, err := repo.Get("2")
+	assert.NoError(t, err)
+	assert.Equal(t, "user2", account.UserID)
+	_, err = repo.Get("3")
+	assert.ErrorIs(t, err, ErrNotFound)
+
+	account.Name = "Renamed"
+	assert.NoError(t, repo.Update(account))
+	account, _ = repo.Get("2")
+	assert.Equal(t, "Renamed", account.Name)
+	assert.ErrorIs(t, repo.Update(Account{ID: "3"}), ErrNotFound)
+
+	assert.NoError(t, repo.Delete("1"))
+	assert.ErrorIs(t, repo.Delete("1"), ErrNotFound)
+	list, err := repo.List()
+	assert.NoError(t, err)
+	assert.Equal(t, []Account{{ID: "2", UserID: "user2", Name: "Renamed"}}, list)
+}
+
+func TestListByAccount(t *testing.T) {
+	repo := NewMemoryTransactions(
+		Transaction{ID: "tx1", AccountID: "1", Amount: 100},
+		Transaction{ID: "tx2", AccountID: "2", Amount: 50},
+	)
+	repo.Create(Transaction{AccountID: "1", Amount: -20})
+
+	list, err := repo.ListByAccount("1")
+	assert.NoError(t, err)
+	assert.Equal(t, []Transaction{{ID: "tx1", AccountID: "1", Amount: 100}, {ID: "tx3", AccountID: "1", Amount: -20}}, list)
+
+	list, _ = repo.ListByAccount("3")
+	assert.Empty(t, list)
+}
+
+func TestFileSurvivesRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "profiles.json")
+	seed := Profile{ID: "1", UserID: "1", Name: "Profile 1"}
+
+	repo, err := NewFileProfiles(path, seed)
+	assert.NoError(t, err)
+	_, err = os.Stat(path)
+	assert.True(t, os.IsNotExist(err), "the seed is only written on the first change")
+
+	created, err := repo.Create(Profile{UserID: "2", Name: "Profile 2"})
+	assert.NoError(t, err)
+	assert.Equal(t, "2", created.ID)
+	assert.NoError(t, repo.Delete("2"))
+	assert.NoError(t, repo.Delete("1"))
+
+	// The saved records win over the seed, and deleted ids stay used
+	reopened, err := NewFileProfiles(path, seed)
+	assert.NoError(t, err)
+	list, _ := reopened.List()
+	assert.Empty(t, list)
+	created, _ = reopened.Create(Profile{UserID: "3", Name: "Profile 3"})
+	assert.Equal(t, "3", created.ID)
+
+	transactions, err := NewFileTransactions(filepath.Join(t.TempDir(), "transactions.json"))
+	assert.NoError(t, err)
+	_, err = transactions.Create(Transaction{ID: "tx1", AccountID: "1"})
+	assert.NoError(t, err)
+	byAccount, _ := transactions.ListByAccount("1")
+	assert.Len(t, byAccount, 1)
+
+	assert.NoError(t, os.WriteFile(path, []byte("not json"), 0o600))
+	_, err = NewFileProfiles(path)
+	assert.Error(t, err)
+}
+
+// A change that cannot be saved is not kept in memory either
+func TestFileUndoesUnsavedChanges(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	assert.NoError(t, os.Mkdir(dir, 0o700))
+	seed := []Profile{{ID: "1", UserID: "1", Name: "Profile 1"}, {ID: "2", UserID: "2", Name: "Profile 2"}}
+	repo, err := NewFileProfiles(filepath.Join(dir, "profiles.json"), seed...)
+	assert.NoError(t, err)
+	assert.NoError(t, os.RemoveAll(dir))
+
+	_, err = repo.Create(Profile{UserID: "3", Name: "Profile 3"})
+	assert.Error(t, err)
+	assert.Error(t, repo.Update(Profile{ID: "1", UserID: "1", Name: "Renamed"}))
+	assert.Error(t, repo.Delete("1"))
+
+	list, _ := repo.List()
+	assert.Equal(t, seed, list, "a deleted record comes back in its place")
+
+	assert.NoError(t, os.Mkdir(dir, 0o700))
+	created, err := repo.Create(Profile{UserID: "3", Name: "Profile 3"})
+	assert.NoError(t, err)
+	assert.Equal(t, "3", created.ID, "the id of the failed create is handed out again")
+}
+
+// A transfer is recorded whole or not at all
+func TestTransfer(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	assert.NoError(t, os.Mkdir(dir, 0o700))
+	file, err := NewFileTransactions(filepath.Join(dir, "transactions.json"), Transaction{ID: "tx1", AccountID: "1", Amount: 100})
+	assert.NoError(t, err)
+	repos := map[string]TransactionRepository{
+		"memory": NewMemoryTransactions(Transaction{ID: "tx1", AccountID: "1", Amount: 100}),
+		"file":   file,
+	}
+
+	for name, repo := range repos {
+		t.Run(name, func(t *testing.T) {
+			debit, credit, err := repo.Transfer(Transaction{AccountID: "1", Amount: -40, TransferID: "t1"}, Transaction{AccountID: "2", Amount: 40, TransferID: "t1"})
+			assert.NoError(t, err)
+			assert.Equal(t, "tx2", debit.ID)
+			assert.Equal(t, "tx3", credit.ID)
+
+			// The credit takes an id that exists, so the debit is not kept either
+			_, _, err = repo.Transfer(Transaction{AccountID: "1", Amount: -40}, Transaction{ID: "tx1", AccountID: "2", Amount: 40})
+			assert.ErrorIs(t, err, ErrExists)
+			list, _ := repo.List()
+			assert.Len(t, list, 3)
+		})
+	}
+
+	// Neither is kept when the file cannot be written
+	assert.NoError(t, os.RemoveAll(dir))
+	_, _, err = file.Transfer(Transaction{AccountID: "1", Amount: -40}, Transaction{AccountID: "2", Amount: 40})
+	assert.Error(t, err)
+	list, _ := file.List()
+	assert.Len(t, list, 3)
+}
+
+func TestGeneratedIDs(t *testing.T) {
+	accounts := NewMemoryAccounts(Account{ID: "1"}, Account{ID: "7"}, Account{ID: "savings"})
+
+	created, err := accounts.Create(Account{Name: "next"})
+	assert.NoError(t, err)
+	assert.Equal(t, "8", created.ID, "generated ids start above the numeric ones seen")
+
+	assert.NoError(t, accounts.Delete("8"))
+	created, _ = accounts.Create(Account{})
+	assert.Equal(t, "9", created.ID, "ids are not handed out again after a deletion")
+
+	// Explicit ids move the counter past them
+	accounts.Create(Account{ID: "20"})
+	created, _ = accounts.Create(Account{})
+	assert.Equal(t, "21", created.ID)
+
+	transactions := NewMemoryTransactions(Transaction{ID: "tx2"})
+	tx, _ := transactions.Create(Transaction{AccountID: "1"})
+	assert.Equal(t, "tx3", tx.ID)
+}
+
+func TestConcurrentUse(t *testing.T) {
+	repo, err := NewFileAccounts(filepath.Join(t.TempDir(), "accounts.json"))
+	assert.NoError(t, err)
+
+	const writers = 16
+	ids := make(chan string, writers*10)
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				account, err := repo.Create(Account{Name: "stress"})
+				assert.NoError(t, err)
+				account.Name = "renamed"
+				assert.NoError(t, repo.Update(account))
+				if j%2 == 0 {
+					assert.NoError(t, repo.Delete(account.ID))
+				}
+				repo.List()
+				ids <- account.ID
+			}
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := map[string]bool{}
+	for id := range ids {
+		assert.False(t, seen[id], "id %s was handed out twice", id)
+		seen[id] = true
+	}
+
+	// The file holds the last state
+	list, _ := repo.List()
+	reopened, err := NewFileAccounts(repo.path)
+	assert.NoError(t, err)
+	saved, _ := reopened.List()
+	assert.Len(t, list, writers*5)
+	assert.ElementsMatch(t, list, saved)
+}
@@ -1,57 +1,197 @@
 package main
 
 import (
+	"context"
+	_ "embed"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
+	"path/filepath"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/repository"
 	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 )
 
-// Claims structure representing the payload of a JWT token
-type Claims struct {
-	UserID string   `json:"user_id"`
-	Roles  []string `json:"roles"`
-	Scopes []string `json:"scopes"`
-	jwt.StandardClaims
+// keySet signs and verifies tokens, main replaces the development secret with the configured keys
+var keySet = authn.NewKeySet(authn.NewHMACKey("", []byte("secret")))
+
+// keyProvider verifies tokens, it also consults the issuer's JWKS when one is configured
+var keyProvider authn.KeyProvider = keySet
+
+// validation restricts which tokens are accepted, main overrides it from the
+// environment. Without JWT_ALGORITHMS a token must use the algorithm of the key
+// that verifies it, so keys the JWKS rotates in work without a restart
+var validation = authn.ValidationOptions{
+	Issuers: []string{"keycloak"},
+	Leeway:  30 * time.Second,
 }
 
-// Generate a sample JWT token for a user
-func generateJWT(userID string, roles []string, scopes []string) (string, error) {
-	claims := Claims{
+// roleRegistry maps the roles in a token to the scopes they grant, main loads it from ROLES_FILE
+var roleRegistry = authz.DefaultRoleRegistry
+
+//go:embed policy.yaml
+var defaultPolicy []byte
+
+// policies holds the route policy in force, policy.yaml until main loads POLICY_FILE
+var policies = authz.MustPolicyStore(defaultPolicy, roleRegistry, authz.DefaultMatcher)
+
+//go:embed relations.yaml
+var defaultRelations []byte
+
+// server holds the data the handlers work on, every router has its own
+type server struct {
+	accounts     repository.AccountRepository
+	transactions repository.TransactionRepository
+	// relations holds who owns, edits and views each account
+	relations *authz.TupleStore
+	// ledger serializes transfers, see createTransfer
+	ledger sync.Mutex
+	// devTokens serves POST /oauth/token for the mock users, never with real keys
+	devTokens bool
+}
+
+// newServer relates every account to its owner and its bank, the relations
+// must define account#owner, account#bank and bank#customer
+func newServer(accounts repository.AccountRepository, transactions repository.TransactionRepository, relations *authz.TupleStore) (*server, error) {
+	s := &server{accounts: accounts, transactions: transactions, relations: relations}
+	relations.Roles = roleRegistry
+	list, err := accounts.List()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range list {
+		if err := s.relateAccount(a); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// newMemoryServer serves the mock data from memory, related by relations.yaml
+func newMemoryServer() *server {
+	s, err := newServer(
+		repository.NewMemoryAccounts(seedAccounts...),
+		repository.NewMemoryTransactions(seedTransactions...),
+		authz.MustParseRelations(defaultRelations),
+	)
+	if err != nil {
+		panic(err)
+	}
+	return s
+}
+
+// repositoriesFromEnv keeps the data in JSON files in DATA_DIR, starting
+// from the mock data, or in memory when it is not set
+func repositoriesFromEnv() (repository.AccountRepository, repository.TransactionRepository, error) {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return repository.NewMemoryAccounts(seedAccounts...), repository.NewMemoryTransactions(seedTransactions...), nil
+	}
+	accounts, err := repository.NewFileAccounts(filepath.Join(dir, "accounts.json"), seedAccounts...)
+	if err != nil {
+		return nil, nil, err
+	}
+	transactions, err := repository.NewFileTransactions(filepath.Join(dir, "transactions.json"), seedTransactions...)
+	if err != nil {
+		return nil, nil, err
+	}
+	return accounts, transactions, nil
+}
+
+func (s *server) relateAccount(a repository.Account) error {
+	object := "account:" + a.ID
+	return s.relations.Write(
+		authz.Tuple{Object: object, Relation: "owner", Subject: "user:" + a.UserID},
+		authz.Tuple{Object: object, Relation: "bank", Subject: "bank:main"},
+		authz.Tuple{Object: "bank:main", Relation: "customer", Subject: "user:" + a.UserID},
+	)
+}
+
+// accessTokenTTL is how long access tokens stay valid, clients renew them with a refresh token
+const accessTokenTTL = time.Minute * 15
+
+// newClaims builds the claims of an access token for a user
+func newClaims(userID string, roles []string, scopes []string) authz.Claims {
+	now := time.Now()
+	return authz.Claims{
 		UserID: userID,
 		Roles:  roles,
 		Scopes: scopes,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour * 24).Unix(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        newTokenID(),
+			Subject:   userID,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(accessTokenTTL)),
 			Issuer:    "keycloak",
 		},
 	}
+}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString([]byte("secret")) // Use a secure secret key in production
+// Generate a sample JWT token for a user
+func generateJWT(userID string, roles []string, scopes []string) (string, error) {
+	return keySet.Active().Sign(newClaims(userID, roles, scopes))
 }
 
 // Extract claims from the token
-func extractClaimsFromToken(authHeader string) (*Claims, error) {
+func extractClaimsFromToken(authHeader string) (*authz.Claims, error) {
+	return authz.VerifyBearer(authHeader, keyProvider, validation)
+}
+
+// introspector authenticates opaque tokens, it is set when INTROSPECTION_URL is configured
+var introspector *authn.Introspector
+
+// authenticate accepts JWTs, and opaque tokens when an introspection endpoint
+// is configured, unless they were revoked before they expired
+func authenticate(ctx context.Context, authHeader string) (*authz.Claims, error) {
+	claims, err := claimsOf(ctx, authHeader)
+	if err != nil {
+		return nil, err
+	}
+	if err := authn.CheckRevoked(revocations, &claims.RegisteredClaims); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+func claimsOf(ctx context.Context, authHeader string) (*authz.Claims, error) {
 	tokenString := strings.TrimPrefix(authHeader, "Bearer ")
-	if tokenString == "" {
-		return nil, fmt.Errorf("token missing")
+	if introspector == nil || tokenString == "" || authn.LooksLikeJWT(tokenString) {
+		return extractClaimsFromToken(authHeader)
 	}
 
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return []byte("secret"), nil // Use a secure secret key in production
-	})
-	if err != nil || !token.Valid {
-		return nil, fmt.Errorf("invalid token")
+	result, err := introspector.Introspect(ctx, tokenString)
+	if err != nil {
+		return nil, err
+	}
+	if err := result.Validate(validation); err != nil {
+		return nil, err
 	}
 
-	claims, ok := token.Claims.(*Claims)
-	if !ok {
-		return nil, fmt.Errorf("could not extract claims")
+	claims := &authz.Claims{
+		UserID:     result.UserID,
+		Roles:      result.Roles,
+		Scopes:     result.Scopes,
+		Attributes: result.Raw,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:       result.ID,
+			Subject:  result.Subject,
+			Issuer:   result.Issuer,
+			Audience: result.Audience,
+		},
+	}
+	if !result.IssuedAt.IsZero() {
+		claims.IssuedAt = jwt.NewNumericDate(result.IssuedAt)
+	}
+	if !result.ExpiresAt.IsZero() {
+		claims.ExpiresAt = jwt.NewNumericDate(result.ExpiresAt)
 	}
 	return claims, nil
 }
@@ -66,122 +206,80 @@ func hasScope(scopes []string, requiredScope string) bool {
 	return false
 }
 
-func Get[T any](c *gin.Context, key string) T {
-	value, exists := c.Get(key)
-	if !exists {
-		var zero T
-		return zero
-	}
-	return value.(T)
+// enforcePolicy authorizes the caller in ClaimsContext against the route policy
+func enforcePolicy() gin.HandlerFunc {
+	return policies.Middleware(authz.ClaimsSubject, authz.LoadedResource(accountAttributes))
 }
 
-const claimKey = "claims"
-
-// Middleware to extract claims from the JWT token
-func ClaimsContext() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		claims, err := extractClaimsFromToken(authHeader)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
-			c.Abort()
-			return
-		}
-
-		c.Set(claimKey, claims)
-		c.Next()
-	}
+// accountRelations names the relation the caller needs on the account in
+// :id, or the one accountIDs finds, by route
+var accountRelations = map[string]string{
+	"GET /accounts/:id":                    "viewer",
+	"PUT /accounts/:id":                    "editor",
+	"DELETE /accounts/:id":                 "owner",
+	"GET /accounts/:id/transactions":       "viewer",
+	"GET /accounts/:id/transactions/:txID": "viewer",
+	"POST /accounts/:id/transactions":      "editor",
+	"POST /transfers":                      "owner",
 }
 
-// Get claims from the context
-func GetClaims(c *gin.Context) (*Claims, bool) {
-	value, exists := c.Get(claimKey)
-	fmt.Println("GetClaims:", value)
-	if !exists {
-		return nil, false
+// enforceRelations checks the relation accountRelations names for the matched route
+func (s *server) enforceRelations() gin.HandlerFunc {
+	checks := map[string]gin.HandlerFunc{}
+	for route, relation := range accountRelations {
+		object := authz.ObjectParam("account", "id")
+		if id, ok := accountIDs[route]; ok {
+			object = func(c *gin.Context) string { return "account:" + id(c) }
+		}
+		checks[route] = s.relations.Require(relation, object, authz.ClaimsSubject)
 	}
-	return value.(*Claims), true
-}
-
-func ownerAccess(pathParam string) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		claims, exists := GetClaims(c)
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "the claims do not exist"})
-			c.Abort()
-			return
-		}
-
-		// Extract the :id from the URL path
-		pathID := c.Param(pathParam)
-
-		// Check if the UserID from the token matches the :id path parameter
-		if claims.UserID != pathID {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-			c.Abort()
-			return
+		if check, ok := checks[c.Request.Method+" "+c.FullPath()]; ok {
+			check(c)
 		}
-
-		// If the check passes, continue to the handler
-		c.Set("user_id", claims.UserID)
-		c.Next()
 	}
 }
 
-// Authorization middleware to verify permissions at the middleware level
-func defineAccess(permissionRequired string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		claims, exists := GetClaims(c)
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "the claims do not exist"})
-			c.Abort()
-			return
-		}
-
-		// Check if the user has the required permission (scope)
-		if !hasScope(claims.Scopes, permissionRequired) {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-			c.Abort()
-			return
-		}
-
-		// Attach user_id to context for later use in handlers
-		c.Set("user_id", claims.UserID)
-		c.Next()
-	}
+// accountIDs finds the account a route acts on where it is not in :id, by route
+var accountIDs = map[string]authz.IDFunc{
+	"POST /transfers": transferSource,
 }
 
-type Account struct {
-	ID     string `json:"id"`
-	UserID string `json:"user_id"`
-	Name   string `json:"name"`
+// loadAccount fetches the account in the :id path parameter, or the one
+// accountIDs finds, before the policy and relations are checked. Routes
+// naming an account that does not exist answer 404
+func (s *server) loadAccount() gin.HandlerFunc {
+	return authz.LoadResourceBy(func(c *gin.Context) string {
+		if id, ok := accountIDs[c.Request.Method+" "+c.FullPath()]; ok {
+			return id(c)
+		}
+		return c.Param("id")
+	}, s.accounts.Get, "Account not found")
 }
 
-type Transaction struct {
-	ID        string  `json:"id"`
-	AccountID string  `json:"account_id"`
-	Amount    float64 `json:"amount"`
-	CreatedAt string  `json:"created_at"`
+// accountAttributes exposes an account to the policy
+func accountAttributes(a repository.Account) map[string]interface{} {
+	return map[string]interface{}{"id": a.ID, "user_id": a.UserID, "name": a.Name}
 }
 
 // Mock data
-var accounts = []Account{
+var seedAccounts = []repository.Account{
 	{ID: "1", UserID: "user1", Name: "Account 1"},
 	{ID: "2", UserID: "user2", Name: "Account 2"},
 	{ID: "3", UserID: "user3", Name: "Account 3"},
 }
 
-var transactions = []Transaction{
+var seedTransactions = []repository.Transaction{
 	{ID: "tx1", AccountID: "1", Amount: 100, CreatedAt: "2024-01-01"},
 	{ID: "tx2", AccountID: "2", Amount: 50, CreatedAt: "2024-01-02"},
 }
 
 // Create an account (only admin or the owner)
-func createAccount(c *gin.Context) {
-	claims, _ := c.Get("user_id")
-	userID := claims.(string)
+func (s *server) createAccount(c *gin.Context) {
+	claims, _ := authz.GetClaims(c)
+	userID := claims.UserID
 
-	var newAccount Account
+	var newAccount repository.Account
 	if err := c.ShouldBindJSON(&newAccount); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -193,131 +291,237 @@ func createAccount(c *gin.Context) {
 		return
 	}
 
-	// Add to accounts list
-	accounts = append(accounts, newAccount)
-	c.JSON(http.StatusCreated, newAccount)
+	// The repository hands out the id, a client picking one could take over
+	// the id of a deleted account or exhaust the counter
+	newAccount.ID = ""
+	account, err := s.accounts.Create(newAccount)
+	if !saved(c, err) {
+		return
+	}
+
+	if err := s.relateAccount(account); err != nil {
+		s.accounts.Delete(account.ID)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, account)
 }
 
-// Get an account (only admin or the owner)
+// Get an account, the policy lets only admin or the owner through
 func getUserAccount(c *gin.Context) {
-	accountID := c.Param("id")
-	userID := c.Param("userID")
-
-	var account *Account
-	for _, a := range accounts {
-		// asssume SELECT * FROM accounts WHERE ID = accountID AND UserID = userID
-		if a.ID == accountID && a.UserID == userID {
-			account = &a
-			break
-		}
-	}
+	account, _ := authz.GetResource[repository.Account](c)
 
-	if account == nil {
+	// asssume SELECT * FROM accounts WHERE ID = accountID AND UserID = userID
+	if account.UserID != c.Param("userID") {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
 		return
 	}
 
-	// No need to check if the user is the owner, as the ownerAccess middleware already does that
+	// No need to check if the user is the owner, the policy checks :userID against the caller
 
 	c.JSON(http.StatusOK, account)
 }
 
-// Get an account (only admin or the owner)
+// Get an account, only its viewers get through enforceRelations
 func getAccount(c *gin.Context) {
-	accountID := c.Param("id")
-	claims, _ := c.Get("user_id")
-	userID := claims.(string)
-
-	var account *Account
-	for _, a := range accounts {
-		if a.ID == accountID {
-			account = &a
-			break
-		}
-	}
+	account, _ := authz.GetResource[repository.Account](c)
+	c.JSON(http.StatusOK, account)
+}
 
-	if account == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+// Update an account, only its editors get through enforceRelations
+func (s *server) updateAccount(c *gin.Context) {
+	account, _ := authz.GetResource[repository.Account](c)
+
+	var updatedAccount repository.Account
+	if err := c.ShouldBindJSON(&updatedAccount); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if the user is admin or the owner of the account
-	// ownerAccess("userID") is a middleware that checks if the user is the owner of the account
-	if account.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
+	account.Name = updatedAccount.Name
+	if !saved(c, s.accounts.Update(account)) {
 		return
 	}
-
 	c.JSON(http.StatusOK, account)
 }
 
-// Update an account (only admin or the owner)
-func updateAccount(c *gin.Context) {
-	accountID := c.Param("id")
-	claims, _ := c.Get("user_id")
-	userID := claims.(string)
+// Delete an account, only its owners get through enforceRelations
+func (s *server) deleteAccount(c *gin.Context) {
+	account, _ := authz.GetResource[repository.Account](c)
 
-	var updatedAccount Account
-	if err := c.ShouldBindJSON(&updatedAccount); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	// Under the ledger lock, so a transaction or transfer in flight is
+	// recorded before the account goes. Its transactions stay as the record,
+	// its id is never reused.
+	s.ledger.Lock()
+	defer s.ledger.Unlock()
+
+	if !saved(c, s.accounts.Delete(account.ID)) {
 		return
 	}
+	s.relations.DeleteObject("account:" + account.ID)
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
+}
+
+// saved answers the request when the account loaded for it could not be
+// changed, e.g. because it was deleted in the meantime
+func saved(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+		return false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
 
-	var account *Account
-	for i, a := range accounts {
-		if a.ID == accountID {
-			account = &accounts[i]
-			break
+func main() {
+	fmt.Println("Server starting...")
+	devMode, err := authn.DevModeFromEnv()
+	if err != nil {
+		fmt.Println("Invalid DEV_TOKEN_ENDPOINT:", err)
+		os.Exit(1)
+	}
+
+	ks, err := authn.KeySetFromEnv()
+	switch {
+	case errors.Is(err, authn.ErrNoKeys):
+	case err != nil:
+		fmt.Println("Failed to load signing keys:", err)
+		os.Exit(1)
+	default:
+		keySet = ks
+		keyProvider = ks
+	}
+
+	jwks, err := authn.JWKSFromEnv(authn.WithErrorLog(func(err error) {
+		fmt.Println("JWKS refresh failed:", err)
+	}))
+	switch {
+	case errors.Is(err, authn.ErrNoKeys):
+	case err != nil:
+		fmt.Println("Failed to load JWKS:", err)
+		os.Exit(1)
+	default:
+		jwks.Start()
+		defer jwks.Stop()
+		// Local keys stay valid next to the issuer's only when explicitly configured
+		if ks != nil {
+			keyProvider = authn.Providers{jwks, ks}
+		} else {
+			keyProvider = jwks
 		}
 	}
 
-	if account == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
-		return
+	// Anyone can sign tokens with the development secret, admin tokens included
+	switch {
+	case !devMode && ks == nil && jwks == nil:
+		fmt.Println("No signing key configured. Set JWT_SECRET, JWT_SECRET_FILE, JWT_PRIVATE_KEY_FILE or JWT_JWKS_URL, or DEV_TOKEN_ENDPOINT=true to use the development secret")
+		os.Exit(1)
+	// The mock users, admin1 included, must never get tokens signed with real keys
+	case devMode && (ks != nil || jwks != nil):
+		fmt.Println("DEV_TOKEN_ENDPOINT is refused when signing keys or a JWKS are configured")
+		os.Exit(1)
+	case devMode:
+		fmt.Println("Development mode, tokens signed with the development secret are accepted")
 	}
 
-	// Check if admin or the user is the owner
-	if account.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
+	validation, err = authn.ValidationOptionsFromEnv(validation)
+	if err != nil {
+		fmt.Println("Invalid token validation options:", err)
+		os.Exit(1)
 	}
 
-	account.Name = updatedAccount.Name
-	c.JSON(http.StatusOK, account)
-}
+	if endpoint := os.Getenv("INTROSPECTION_URL"); endpoint != "" {
+		introspector = authn.NewIntrospector(endpoint, os.Getenv("INTROSPECTION_CLIENT_ID"), os.Getenv("INTROSPECTION_CLIENT_SECRET"))
+		if field := os.Getenv("INTROSPECTION_ROLES_FIELD"); field != "" {
+			introspector.RolesField = field
+		}
+		if field := os.Getenv("INTROSPECTION_USER_ID_FIELD"); field != "" {
+			introspector.UserIDField = field
+		}
+	}
 
-// Delete an account (only admin or the owner)
-func deleteAccount(c *gin.Context) {
-	accountID := c.Param("id")
-	claims, _ := c.Get("user_id")
-	userID := claims.(string)
-
-	var account *Account
-	for i, a := range accounts {
-		if a.ID == accountID {
-			account = &a
-			accounts = append(accounts[:i], accounts[i+1:]...)
-			break
+	roleRegistry, err = authz.RoleRegistryFromEnv(roleRegistry)
+	if err != nil {
+		fmt.Println("Failed to load roles:", err)
+		os.Exit(1)
+	}
+
+	relations := authz.MustParseRelations(defaultRelations)
+	if path := os.Getenv("RELATIONS_FILE"); path != "" {
+		if relations, err = authz.LoadRelations(path); err != nil {
+			fmt.Println("Failed to load relations:", err)
+			os.Exit(1)
 		}
 	}
 
-	if account == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
-		return
+	accounts, transactions, err := repositoriesFromEnv()
+	if err != nil {
+		fmt.Println("Failed to load data:", err)
+		os.Exit(1)
+	}
+	s, err := newServer(accounts, transactions, relations)
+	if err != nil {
+		fmt.Println("Failed to relate accounts:", err)
+		os.Exit(1)
 	}
+	s.devTokens = devMode
 
-	// Check if admin or the user is the owner
-	if account.UserID != userID {
-		c.JSON(http.StatusForbidden, gin.H{"error": "Permission denied"})
-		return
+	policies, err = authz.PolicyStoreFromEnv(defaultPolicy, roleRegistry, authz.DefaultMatcher)
+	if err != nil {
+		fmt.Println("Failed to load policy:", err)
+		os.Exit(1)
+	}
+	interval, err := authz.ReloadIntervalFromEnv()
+	if err != nil {
+		fmt.Println("Invalid POLICY_RELOAD_INTERVAL:", err)
+		os.Exit(1)
+	}
+	policies.Logf = log.Printf
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		policies.Watch(path, interval)
+		defer policies.Stop()
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Account deleted"})
-}
+	// A candidate policy is only logged and counted, the policy above still decides
+	if policies.Shadow, err = authz.ShadowFromEnv(roleRegistry, authz.DefaultMatcher); err != nil {
+		fmt.Println("Failed to load the shadow policy:", err)
+		os.Exit(1)
+	}
+	if policies.Shadow != nil {
+		policies.Shadow.Candidate.Logf = log.Printf
+		policies.Shadow.Candidate.Watch(os.Getenv("SHADOW_POLICY_FILE"), interval)
+		defer policies.Shadow.Candidate.Stop()
+	}
 
-func main() {
-	fmt.Println("Server starting...")
-	r := setupRouter()
+	debug, err := authz.DebugFromEnv()
+	if err != nil {
+		fmt.Println("Invalid AUTHZ_DEBUG:", err)
+		os.Exit(1)
+	}
+	logDecisions, err := authz.LogDecisionsFromEnv()
+	if err != nil {
+		fmt.Println("Invalid AUTHZ_LOG_DECISIONS:", err)
+		os.Exit(1)
+	}
+	if logDecisions {
+		policies.LogDecision = authz.PrintDecision
+	}
+	policies.Debug, relations.Debug = debug, debug
+
+	if path := os.Getenv("REVOCATION_FILE"); path != "" {
+		store, err := authn.NewFileRevocationStore(path)
+		if err != nil {
+			fmt.Println("Failed to load revocations:", err)
+			os.Exit(1)
+		}
+		revocations = store
+	}
+
+	r := s.router()
 
 	port := os.Getenv("PORT")
 	if port == "" {
@@ -327,21 +531,48 @@ func main() {
 	r.Run(":" + port)
 }
 
+// setupRouter serves the mock data from memory, every call starts from scratch
 func setupRouter() *gin.Engine {
+	return newMemoryServer().router()
+}
+
+func (s *server) router() *gin.Engine {
 	r := gin.Default()
 
-	r.Use(ClaimsContext())
+	// The token endpoint authenticates with credentials or a refresh token, so it is registered before ClaimsContext
+	if s.devTokens {
+		r.POST("/oauth/token", issueToken)
+	}
+
+	// Every route below is authorized by policy.yaml, a route without a rule is
+	// denied, and the account routes in accountRelations by relations.yaml. The
+	// account in :id is loaded first, so nothing runs for one that does not exist
+	r.Use(authz.ClaimsContext(authenticate), s.loadAccount(), enforcePolicy(), s.enforceRelations())
+
+	// Account routes
+	r.POST("/accounts", s.createAccount)
+
+	r.GET("/accounts/:id", getAccount)
+	r.GET("/users/:userID/accounts/:id", getUserAccount)
 
-	// Define routes with authorization checks
+	r.PUT("/accounts/:id", s.updateAccount)
+	r.DELETE("/accounts/:id", s.deleteAccount)
 
-	// Account routes - employee can only manage their own accounts
-	r.POST("/accounts", defineAccess("user:write:self"), createAccount)
+	// Transaction routes, whoever may view or edit an account may do the same with its transactions
+	r.GET("/transactions", s.listTransactions)
+	r.GET("/accounts/:id/transactions", s.listAccountTransactions)
+	r.GET("/accounts/:id/transactions/:txID", s.getAccountTransaction)
+	r.POST("/accounts/:id/transactions", s.createAccountTransaction)
 
-	r.GET("/accounts/:id", defineAccess("user:read:self"), getAccount)
-	r.GET("/users/:userID/accounts/:id", defineAccess("user:read:self"), ownerAccess("userID"), getUserAccount)
+	// Transfers act on two accounts, the policy checks the source and relations.yaml the destination
+	r.POST("/transfers", s.destinationExists, s.relations.Require("depositor", transferDestination, authz.ClaimsSubject), s.createTransfer)
 
-	r.PUT("/accounts/:id", defineAccess("user:write:self"), updateAccount)
-	r.DELETE("/accounts/:id", defineAccess("user:write:self"), deleteAccount)
+	// Admin routes
+	r.POST("/admin/revocations", revokeTokens)
+	r.GET("/admin/policy", getPolicy)
+	r.PUT("/admin/policy", updatePolicy)
+	r.GET("/admin/policy/shadow", getShadowStats)
+	r.POST("/authz/explain", s.explainDecision)
 
 	return r
 }
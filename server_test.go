@@ -2,11 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -24,7 +32,7 @@ func TestCreateAccount(t *testing.T) {
 		name          string
 		userID        string
 		scopes        []string
-		payload       Account
+		payload       repository.Account
 		expectedCode  int
 		expectedError string
 	}{
@@ -32,7 +40,7 @@ func TestCreateAccount(t *testing.T) {
 			name:          "Create own account",
 			userID:        "user1",
 			scopes:        []string{"user:write:self"},
-			payload:       Account{ID: "3", UserID: "user1", Name: "Account 3"},
+			payload:       repository.Account{UserID: "user1", Name: "Account 4"},
 			expectedCode:  http.StatusCreated,
 			expectedError: "",
 		},
@@ -40,7 +48,7 @@ func TestCreateAccount(t *testing.T) {
 			name:          "Forbidden when trying to create an account for another user",
 			userID:        "user1",
 			scopes:        []string{"user:write:self"},
-			payload:       Account{ID: "4", UserID: "user2", Name: "Account 4"},
+			payload:       repository.Account{UserID: "user2", Name: "Account 5"},
 			expectedCode:  http.StatusForbidden,
 			expectedError: "Permission denied",
 		},
@@ -75,6 +83,38 @@ func TestCreateAccount(t *testing.T) {
 	}
 }
 
+// The id in the body is ignored, the repository hands out the next one
+func TestCreateAccountIgnoresID(t *testing.T) {
+	s := newMemoryServer()
+	r := s.router()
+	token := generateMockJWT("user1", []string{"user:write:self"})
+
+	for _, id := range []string{"1", "18446744073709551615", "4"} {
+		t.Run(id, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			reqBody, _ := json.Marshal(repository.Account{ID: id, UserID: "user1", Name: "Account " + id})
+			req, _ := http.NewRequest(http.MethodPost, "/accounts", bytes.NewReader(reqBody))
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+
+			var created repository.Account
+			json.Unmarshal(w.Body.Bytes(), &created)
+			assert.NotEqual(t, "1", created.ID)
+			assert.NotEqual(t, "18446744073709551615", created.ID)
+		})
+	}
+
+	accounts, _ := s.accounts.List()
+	ids := []string{}
+	for _, a := range accounts {
+		ids = append(ids, a.ID)
+	}
+	assert.Equal(t, []string{"1", "2", "3", "4", "5", "6"}, ids)
+	first, _ := s.accounts.Get("1")
+	assert.Equal(t, "Account 1", first.Name, "an existing account is not touched")
+}
+
 // Test the "get account" endpoint
 func TestGetUserAccount(t *testing.T) {
 	r := setupRouter()
@@ -216,7 +256,7 @@ func TestUpdateAccount(t *testing.T) {
 		userID        string
 		scopes        []string
 		accountID     string
-		payload       Account
+		payload       repository.Account
 		expectedCode  int
 		expectedError string
 	}{
@@ -225,7 +265,7 @@ func TestUpdateAccount(t *testing.T) {
 			userID:        "user1",
 			scopes:        []string{"user:write:self"},
 			accountID:     "1",
-			payload:       Account{ID: "1", UserID: "user1", Name: "Updated Account 1"},
+			payload:       repository.Account{ID: "1", UserID: "user1", Name: "Updated Account 1"},
 			expectedCode:  http.StatusOK,
 			expectedError: "",
 		},
@@ -234,7 +274,7 @@ func TestUpdateAccount(t *testing.T) {
 			userID:        "user1",
 			scopes:        []string{"user:write:self"},
 			accountID:     "2",
-			payload:       Account{ID: "2", UserID: "user2", Name: "Updated Account 2"},
+			payload:       repository.Account{ID: "2", UserID: "user2", Name: "Updated Account 2"},
 			expectedCode:  http.StatusForbidden,
 			expectedError: "Permission denied",
 		},
@@ -269,7 +309,8 @@ func TestUpdateAccount(t *testing.T) {
 
 // Test the "delete account" endpoint
 func TestDeleteAccount(t *testing.T) {
-	r := setupRouter()
+	s := newMemoryServer()
+	r := s.router()
 
 	tests := []struct {
 		name          string
@@ -312,6 +353,10 @@ func TestDeleteAccount(t *testing.T) {
 			// Assert response code
 			assert.Equal(t, tt.expectedCode, w.Code)
 
+			// The account is only removed once the caller was authorized
+			_, err := s.accounts.Get(tt.accountID)
+			assert.Equal(t, tt.expectedCode != http.StatusOK, err == nil)
+
 			if tt.expectedCode != http.StatusOK {
 				// Check if the error message is present
 				var response map[string]interface{}
@@ -322,3 +367,306 @@ func TestDeleteAccount(t *testing.T) {
 		})
 	}
 }
+
+// Test that tokens issued by an external issuer are verified through its JWKS
+func TestJWKSKeyProvider(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	issuerKey, _ := authn.NewKey("issuer-1", rsaKey)
+	jwk, _ := issuerKey.JWK()
+
+	issuer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(authn.JWKSet{Keys: []authn.JWK{jwk}})
+	}))
+	defer issuer.Close()
+
+	jwks, err := authn.NewJWKS(issuer.URL)
+	assert.NoError(t, err)
+
+	previousKeys, previousValidation := keyProvider, validation
+	keyProvider = jwks
+	validation.Algorithms = []string{"RS256"}
+	defer func() { keyProvider, validation = previousKeys, previousValidation }()
+
+	r := setupRouter()
+
+	issued, _ := issuerKey.Sign(authz.Claims{UserID: "user3", Scopes: []string{"user:read:self"}, RegisteredClaims: jwt.RegisteredClaims{Issuer: "keycloak"}})
+	local := generateMockJWT("user3", []string{"user:read:self"})
+
+	for token, expectedCode := range map[string]int{issued: http.StatusOK, local: http.StatusUnauthorized} {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(http.MethodGet, "/accounts/3", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+
+		assert.Equal(t, expectedCode, w.Code)
+	}
+}
+
+// Test that rejected tokens report why they were rejected
+func TestTokenValidationErrors(t *testing.T) {
+	r := setupRouter()
+
+	sign := func(method jwt.SigningMethod, registered jwt.RegisteredClaims) string {
+		token, _ := jwt.NewWithClaims(method, authz.Claims{UserID: "user3", Scopes: []string{"user:read:self"}, RegisteredClaims: registered}).SignedString([]byte("secret"))
+		return token
+	}
+
+	tests := []struct {
+		name         string
+		token        string
+		expectedCode string
+	}{
+		{name: "Missing token", token: "", expectedCode: authn.CodeTokenMissing},
+		{name: "HMAC algorithm outside the allow-list", token: sign(jwt.SigningMethodHS384, jwt.RegisteredClaims{Issuer: "keycloak"}), expectedCode: authn.CodeUnsupportedAlgorithm},
+		{name: "Expired token", token: sign(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "keycloak", ExpiresAt: jwt.NewNumericDate(time.Now().Add(-time.Hour))}), expectedCode: authn.CodeTokenExpired},
+		{name: "Unknown issuer", token: sign(jwt.SigningMethodHS256, jwt.RegisteredClaims{Issuer: "someone-else"}), expectedCode: authn.CodeInvalidIssuer},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/accounts/3", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+			var response map[string]interface{}
+			err := json.Unmarshal(w.Body.Bytes(), &response)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expectedCode, response["code"])
+		})
+	}
+}
+
+// Test that opaque tokens are authenticated through the introspection endpoint
+func TestIntrospectedTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.PostFormValue("token") {
+		case "opaque-user3":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"active": true,
+				"sub":    "user3",
+				"scope":  "user:read:self",
+				"roles":  []string{"user"},
+				"iss":    "keycloak",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+			})
+		case "opaque-other-issuer":
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"active": true,
+				"sub":    "user3",
+				"scope":  "user:read:self",
+				"iss":    "elsewhere",
+				"exp":    time.Now().Add(time.Hour).Unix(),
+			})
+		default:
+			json.NewEncoder(w).Encode(map[string]interface{}{"active": false})
+		}
+	}))
+	defer server.Close()
+
+	introspector = authn.NewIntrospector(server.URL, "", "")
+	defer func() { introspector = nil }()
+
+	r := setupRouter()
+
+	tests := []struct {
+		name         string
+		token        string
+		expectedCode int
+	}{
+		{name: "Active opaque token", token: "opaque-user3", expectedCode: http.StatusOK},
+		{name: "Inactive opaque token", token: "opaque-unknown", expectedCode: http.StatusUnauthorized},
+		{name: "Issuer not accepted", token: "opaque-other-issuer", expectedCode: http.StatusUnauthorized},
+		{name: "JWTs are still parsed locally", token: generateMockJWT("user3", []string{"user:read:self"}), expectedCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/accounts/3", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			r.ServeHTTP(w, req)
+
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+// Roles grant the scopes the role registry maps them to
+func TestRoleDerivedScopes(t *testing.T) {
+	r := setupRouter()
+
+	tests := []struct {
+		name         string
+		roles        []string
+		scopes       []string
+		expectedCode int
+	}{
+		{name: "Role grants the scope", roles: []string{"user"}, expectedCode: http.StatusOK},
+		{name: "Explicit scope without a role", scopes: []string{"user:read:self"}, expectedCode: http.StatusOK},
+		{name: "Inherited role grants the scope", roles: []string{"admin"}, expectedCode: http.StatusOK},
+		{name: "Unknown role grants nothing", roles: []string{"guest"}, expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := generateJWT("user3", tt.roles, tt.scopes)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/accounts/3", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+// Routes without a rule in the policy are denied
+func TestPolicyDefaultDeny(t *testing.T) {
+	r := setupRouter()
+	r.GET("/unlisted", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	token, _ := generateJWT("admin1", []string{"admin"}, []string{"admin:read:all", "admin:write:all"})
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/unlisted", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+}
+
+// Every route but the token endpoint has a rule in policy.yaml
+func TestPolicyCoversRoutes(t *testing.T) {
+	for _, route := range setupRouter().Routes() {
+		if route.Path == "/oauth/token" {
+			continue
+		}
+		assert.True(t, policies.Authorizer().HasRules(route.Method, route.Path), "no rule for %s %s", route.Method, route.Path)
+	}
+}
+
+// Custom claims and the account reach policy conditions
+func TestPolicyConditions(t *testing.T) {
+	previous := policies
+	policies = authz.MustPolicyStore([]byte(`
+rules:
+  - method: GET
+    path: /accounts/:id
+    conditions:
+      - {attribute: subject.department, operator: eq, value: finance}
+      - {attribute: resource.user_id, operator: eq, value: user3}
+`), roleRegistry, authz.DefaultMatcher)
+	defer func() { policies = previous }()
+	r := setupRouter()
+
+	sign := func(department string) string {
+		claims := newClaims("user3", []string{"user"}, nil)
+		token, _ := keySet.Active().Sign(jwt.MapClaims{
+			"user_id":    claims.UserID,
+			"iss":        claims.Issuer,
+			"exp":        claims.ExpiresAt.Unix(),
+			"department": department,
+		})
+		return token
+	}
+
+	tests := []struct {
+		name         string
+		department   string
+		accountID    string
+		expectedCode int
+	}{
+		{name: "Department and account match", department: "finance", accountID: "3", expectedCode: http.StatusOK},
+		{name: "Other department", department: "sales", accountID: "3", expectedCode: http.StatusForbidden},
+		{name: "Other account", department: "finance", accountID: "2", expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/accounts/"+tt.accountID, nil)
+			req.Header.Set("Authorization", "Bearer "+sign(tt.department))
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+// The owner and admins reach an account, nobody else
+func TestAccountOwnerAndAdmin(t *testing.T) {
+	r := setupRouter()
+
+	tests := []struct {
+		name         string
+		userID       string
+		roles        []string
+		expectedCode int
+	}{
+		{name: "Owner", userID: "user3", roles: []string{"user"}, expectedCode: http.StatusOK},
+		{name: "Admin", userID: "admin1", roles: []string{"admin"}, expectedCode: http.StatusOK},
+		{name: "Someone else", userID: "user2", roles: []string{"user"}, expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := generateJWT(tt.userID, tt.roles, nil)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/accounts/3", nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+// Joint owners, delegated viewers and household members reach accounts through relations.yaml
+func TestSharedAccounts(t *testing.T) {
+	r := setupRouter()
+
+	tests := []struct {
+		name         string
+		userID       string
+		method       string
+		accountID    string
+		expectedCode int
+	}{
+		{name: "Joint owner reads", userID: "user4", method: http.MethodGet, accountID: "2", expectedCode: http.StatusOK},
+		{name: "Joint owner updates", userID: "user4", method: http.MethodPut, accountID: "2", expectedCode: http.StatusOK},
+		{name: "Delegated viewer reads", userID: "user5", method: http.MethodGet, accountID: "3", expectedCode: http.StatusOK},
+		{name: "Delegated viewer cannot update", userID: "user5", method: http.MethodPut, accountID: "3", expectedCode: http.StatusForbidden},
+		{name: "Household member reads", userID: "user6", method: http.MethodGet, accountID: "2", expectedCode: http.StatusOK},
+		{name: "Nested household member reads", userID: "user7", method: http.MethodGet, accountID: "2", expectedCode: http.StatusOK},
+		{name: "Household member cannot delete", userID: "user7", method: http.MethodDelete, accountID: "2", expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := generateJWT(tt.userID, []string{"user"}, nil)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, "/accounts/"+tt.accountID, bytes.NewReader([]byte(`{"name":"Shared"}`)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code)
+		})
+	}
+}
+
+// Every router starts from the mock data, a deletion through one is not seen by another
+func TestRoutersDoNotShareData(t *testing.T) {
+	first, second := setupRouter(), setupRouter()
+	token := generateMockJWT("user1", []string{"user:read:self", "user:write:self"})
+
+	do := func(r http.Handler, method string) int {
+		w := httptest.NewRecorder()
+		req, _ := http.NewRequest(method, "/accounts/1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do(first, http.MethodDelete))
+	assert.Equal(t, http.StatusNotFound, do(first, http.MethodGet))
+	assert.Equal(t, http.StatusOK, do(second, http.MethodGet))
+}
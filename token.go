@@ -0,0 +1,153 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/gin-gonic/gin"
+)
+
+// refreshTokenTTL is how long a refresh token can be traded for new tokens
+const refreshTokenTTL = time.Hour * 24
+
+var refreshTokens = authn.NewRefreshStore(refreshTokenTTL)
+
+// devUser is a local account for test environments without a real identity provider
+type devUser struct {
+	Password string
+	Roles    []string
+	Scopes   []string
+}
+
+// Mock users for the password grant
+var devUsers = map[string]devUser{
+	"user1":  {Password: "password", Roles: []string{"user"}, Scopes: []string{"user:read:self", "user:write:self"}},
+	"user2":  {Password: "password", Roles: []string{"user"}, Scopes: []string{"user:read:self", "user:write:self"}},
+	"user3":  {Password: "password", Roles: []string{"user"}, Scopes: []string{"user:read:self", "user:write:self"}},
+	"admin1": {Password: "password", Roles: []string{"admin"}, Scopes: []string{"admin:read:all", "admin:write:all"}},
+}
+
+// TokenRequest is an OAuth 2.0 token request (RFC 6749), as a form or JSON
+type TokenRequest struct {
+	GrantType    string `form:"grant_type" json:"grant_type" binding:"required"`
+	Username     string `form:"username" json:"username"`
+	Password     string `form:"password" json:"password"`
+	RefreshToken string `form:"refresh_token" json:"refresh_token"`
+	Scope        string `form:"scope" json:"scope"`
+}
+
+// TokenResponse is an OAuth 2.0 token response
+type TokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+// scopeError reports a requested scope the grant does not hold
+type scopeError struct {
+	scope string
+}
+
+func (e *scopeError) Error() string {
+	return "scope " + e.scope + " was not granted"
+}
+
+// narrowScopes returns the scopes of the space separated requested list, or
+// all granted ones when it is empty. Clients may ask for fewer scopes than
+// granted, never more.
+func narrowScopes(requested string, granted []string) ([]string, error) {
+	if requested == "" {
+		return granted, nil
+	}
+	scopes := strings.Fields(requested)
+	for _, scope := range scopes {
+		if !hasScope(granted, scope) {
+			return nil, &scopeError{scope: scope}
+		}
+	}
+	return scopes, nil
+}
+
+func tokenError(c *gin.Context, code, description string) {
+	c.JSON(http.StatusBadRequest, gin.H{"error": code, "error_description": description})
+}
+
+// Issue a short-lived access token and a rotating refresh token
+func issueToken(c *gin.Context) {
+	var req TokenRequest
+	if err := c.ShouldBind(&req); err != nil {
+		tokenError(c, "invalid_request", err.Error())
+		return
+	}
+
+	var refresh *authn.RefreshToken
+	var scopes []string
+	var err error
+	switch req.GrantType {
+	case "password":
+		user, ok := devUsers[req.Username]
+		if !ok || subtle.ConstantTimeCompare([]byte(user.Password), []byte(req.Password)) != 1 {
+			tokenError(c, "invalid_grant", "invalid username or password")
+			return
+		}
+		if scopes, err = narrowScopes(req.Scope, user.Scopes); err != nil {
+			tokenError(c, "invalid_scope", err.Error())
+			return
+		}
+		refresh, err = refreshTokens.Issue(authn.Grant{Subject: req.Username, Roles: user.Roles, Scopes: user.Scopes})
+	case "refresh_token":
+		// The scope is checked before the token is spent, a rejected request leaves it valid for a retry
+		refresh, err = refreshTokens.RotateIf(req.RefreshToken, func(grant authn.Grant) error {
+			var err error
+			scopes, err = narrowScopes(req.Scope, grant.Scopes)
+			return err
+		})
+		var reuse *authn.ReuseError
+		var invalidScope *scopeError
+		switch {
+		case errors.As(err, &reuse):
+			// A replayed refresh token means it leaked, kill every access token of the family
+			for jti, exp := range reuse.AccessTokens {
+				revocations.RevokeToken(jti, exp)
+			}
+			tokenError(c, "invalid_grant", err.Error())
+			return
+		case errors.As(err, &invalidScope):
+			tokenError(c, "invalid_scope", err.Error())
+			return
+		case err != nil:
+			tokenError(c, "invalid_grant", err.Error())
+			return
+		}
+	default:
+		tokenError(c, "unsupported_grant_type", "grant_type must be password or refresh_token")
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	claims := newClaims(refresh.Grant.Subject, refresh.Grant.Roles, scopes)
+	accessToken, err := keySet.Active().Sign(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	refreshTokens.TrackAccessToken(refresh.Family, claims.ID, claims.ExpiresAt.Time)
+
+	c.Header("Cache-Control", "no-store")
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTokenTTL.Seconds()),
+		RefreshToken: refresh.Token,
+		Scope:        strings.Join(scopes, " "),
+	})
+}
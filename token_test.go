@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/stretchr/testify/assert"
+)
+
+func requestToken(r http.Handler, form url.Values) (*httptest.ResponseRecorder, TokenResponse) {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/oauth/token", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.ServeHTTP(w, req)
+
+	var response TokenResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	return w, response
+}
+
+func getAccountWith(r http.Handler, token, accountID string) int {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodGet, "/accounts/"+accountID, nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	return w.Code
+}
+
+// Test the password and refresh token grants
+func TestTokenEndpoint(t *testing.T) {
+	previous := revocations
+	revocations = authn.NewMemoryRevocationStore()
+	defer func() { revocations = previous }()
+
+	s := newMemoryServer()
+	s.devTokens = true
+	r := s.router()
+
+	t.Run("Password grant issues a short-lived access token and a refresh token", func(t *testing.T) {
+		w, tokens := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"password"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "Bearer", tokens.TokenType)
+		assert.Equal(t, 900, tokens.ExpiresIn)
+		assert.NotEmpty(t, tokens.RefreshToken)
+		assert.Equal(t, http.StatusOK, getAccountWith(r, tokens.AccessToken, "3"))
+	})
+
+	t.Run("Wrong password", func(t *testing.T) {
+		w, _ := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"guess"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_grant")
+	})
+
+	t.Run("Refresh re-derives the same claims and rotates the refresh token", func(t *testing.T) {
+		_, first := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"password"}})
+		w, second := requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotEqual(t, first.RefreshToken, second.RefreshToken)
+		assert.Equal(t, first.Scope, second.Scope)
+
+		claims, err := extractClaimsFromToken("Bearer " + second.AccessToken)
+		assert.NoError(t, err)
+		assert.Equal(t, "user3", claims.UserID)
+		assert.Equal(t, []string{"user"}, claims.Roles)
+	})
+
+	t.Run("Refresh may narrow but not widen scopes", func(t *testing.T) {
+		_, first := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"password"}})
+
+		w, narrowed := requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}, "scope": {"user:read:self"}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, "user:read:self", narrowed.Scope)
+
+		w, _ = requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {narrowed.RefreshToken}, "scope": {"admin:read:all"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_scope")
+	})
+
+	t.Run("Reusing a refresh token revokes the whole family", func(t *testing.T) {
+		_, first := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"password"}})
+		_, second := requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+
+		w, _ := requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		w, _ = requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {second.RefreshToken}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+
+		assert.Equal(t, http.StatusUnauthorized, getAccountWith(r, first.AccessToken, "3"))
+		assert.Equal(t, http.StatusUnauthorized, getAccountWith(r, second.AccessToken, "3"))
+	})
+
+	t.Run("A rejected scope leaves the refresh token valid", func(t *testing.T) {
+		_, first := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"password"}})
+
+		w, _ := requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}, "scope": {"admin:read:all"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_scope")
+
+		w, retried := requestToken(r, url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.Equal(t, http.StatusOK, getAccountWith(r, retried.AccessToken, "3"))
+	})
+
+	t.Run("Password grant with a scope the user does not hold", func(t *testing.T) {
+		w, _ := requestToken(r, url.Values{"grant_type": {"password"}, "username": {"user3"}, "password": {"password"}, "scope": {"admin:write:all"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "invalid_scope")
+	})
+
+	t.Run("Unsupported grant type", func(t *testing.T) {
+		w, _ := requestToken(r, url.Values{"grant_type": {"client_credentials"}})
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Contains(t, w.Body.String(), "unsupported_grant_type")
+	})
+}
+
+// The token endpoint signs tokens for the mock users, it is off unless DEV_TOKEN_ENDPOINT turns it on
+func TestTokenEndpointOffByDefault(t *testing.T) {
+	w, _ := requestToken(setupRouter(), url.Values{"grant_type": {"password"}, "username": {"admin1"}, "password": {"password"}})
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+}
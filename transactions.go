@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// readAll is the scope that lets a caller list the transactions of every account
+var readAll = []authz.Scope{authz.MustParseScope("admin:read:all")}
+
+// writeAll is the scope that lets a caller pay money into an account from outside the bank
+var writeAll = []authz.Scope{authz.MustParseScope("admin:write:all")}
+
+// readsAll reports whether the caller holds admin:read:all, in the token or through a role
+func readsAll(c *gin.Context) bool {
+	return holds(c, readAll)
+}
+
+// writesAll reports whether the caller holds admin:write:all, in the token or through a role
+func writesAll(c *gin.Context) bool {
+	return holds(c, writeAll)
+}
+
+// holds reports whether the caller holds any of required, in the token or through a role
+func holds(c *gin.Context, required []authz.Scope) bool {
+	caller, _ := authz.ClaimsSubject(c)
+	granted := append(roleRegistry.Scopes(caller.Roles...), authz.ParseScopes(caller.Scopes)...)
+	_, ok := authz.DefaultMatcher.MatchAny(granted, required, nil)
+	return ok
+}
+
+// List transactions across accounts. Admins with admin:read:all see every
+// account's, anyone else only those of the accounts they are a viewer of in
+// relations.yaml, the same as GET /accounts/:id/transactions. ?account_id=
+// narrows the list to one account.
+func (s *server) listTransactions(c *gin.Context) {
+	caller, _ := authz.ClaimsSubject(c)
+
+	visible := func(repository.Transaction) bool { return true }
+	if !readsAll(c) {
+		accounts, err := s.accounts.List()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		viewed := map[string]bool{}
+		for _, a := range accounts {
+			if s.relations.Decide("account:"+a.ID, "viewer", caller).Allowed {
+				viewed[a.ID] = true
+			}
+		}
+		visible = func(t repository.Transaction) bool { return viewed[t.AccountID] }
+	}
+
+	all, err := s.transactions.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	accountID := c.Query("account_id")
+	transactions := []repository.Transaction{}
+	for _, t := range all {
+		if visible(t) && (accountID == "" || t.AccountID == accountID) {
+			transactions = append(transactions, t)
+		}
+	}
+	c.JSON(http.StatusOK, transactions)
+}
+
+// List the transactions of an account, relations.yaml lets only its viewers through
+func (s *server) listAccountTransactions(c *gin.Context) {
+	account, _ := authz.GetResource[repository.Account](c)
+
+	transactions, err := s.transactions.ListByAccount(account.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, transactions)
+}
+
+// Get a transaction of an account, one of another account is not found
+func (s *server) getAccountTransaction(c *gin.Context) {
+	account, _ := authz.GetResource[repository.Account](c)
+
+	transaction, err := s.transactions.Get(c.Param("txID"))
+	switch {
+	case errors.Is(err, repository.ErrNotFound), err == nil && transaction.AccountID != account.ID:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Transaction not found"})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, transaction)
+}
+
+// TransactionRequest moves Amount in (positive) or out (negative) of an account
+type TransactionRequest struct {
+	Amount float64 `json:"amount" binding:"required"`
+}
+
+// Record a transaction on an account, relations.yaml lets only its editors
+// through. A withdrawal cannot take more than the balance. A deposit brings
+// money in from outside the bank, so it takes admin:write:all: customers
+// move money between accounts with a transfer.
+func (s *server) createAccountTransaction(c *gin.Context) {
+	account, _ := authz.GetResource[repository.Account](c)
+
+	var req TransactionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Amount > 0 && !writesAll(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Deposits take admin:write:all, use a transfer"})
+		return
+	}
+
+	// The same lock as transfers, so a withdrawal and a transfer cannot spend
+	// the balance twice, nor can the account be deleted in between
+	s.ledger.Lock()
+	defer s.ledger.Unlock()
+
+	if _, err := s.accounts.Get(account.ID); !saved(c, err) {
+		return
+	}
+	if req.Amount < 0 {
+		balance, err := s.balance(account.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if balance < -req.Amount {
+			c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Insufficient balance"})
+			return
+		}
+	}
+
+	transaction, err := s.transactions.Create(repository.Transaction{
+		AccountID: account.ID,
+		Amount:    req.Amount,
+		CreatedAt: time.Now().UTC().Format(time.DateOnly),
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, transaction)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/stretchr/testify/assert"
+)
+
+// Whoever may view an account reads its transactions, whoever may edit it
+// records them, as relations.yaml says for the account
+func TestAccountTransactions(t *testing.T) {
+	tests := []struct {
+		name         string
+		userID       string
+		roles        []string
+		scopes       []string
+		method       string
+		url          string
+		body         string
+		expectedCode int
+		expectedBody string
+	}{
+		{name: "Owner lists", userID: "user1", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions", expectedCode: http.StatusOK, expectedBody: `"id":"tx1"`},
+		{name: "Other user lists", userID: "user2", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions", expectedCode: http.StatusForbidden},
+		{name: "Admin lists", userID: "admin1", roles: []string{"admin"}, method: http.MethodGet, url: "/accounts/1/transactions", expectedCode: http.StatusOK, expectedBody: `"id":"tx1"`},
+		{name: "Admin with a self scope only", userID: "admin1", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions", expectedCode: http.StatusForbidden},
+		{name: "Owner gets one", userID: "user1", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions/tx1", expectedCode: http.StatusOK, expectedBody: `"amount":100`},
+		{name: "Other user gets one", userID: "user2", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions/tx1", expectedCode: http.StatusForbidden},
+		{name: "Transaction of another account", userID: "user1", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions/tx2", expectedCode: http.StatusNotFound},
+		{name: "Missing transaction", userID: "user1", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/1/transactions/tx9", expectedCode: http.StatusNotFound},
+		{name: "Missing account", userID: "user1", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/9/transactions", expectedCode: http.StatusNotFound},
+		{name: "Owner creates", userID: "user1", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":-25}`, expectedCode: http.StatusCreated, expectedBody: `"id":"tx3","account_id":"1","amount":-25`},
+		{name: "Owner reads but cannot write", userID: "user1", scopes: []string{"user:read:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":25}`, expectedCode: http.StatusForbidden},
+		{name: "Other user creates", userID: "user2", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":25}`, expectedCode: http.StatusForbidden},
+		{name: "Amount missing", userID: "user1", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{}`, expectedCode: http.StatusBadRequest},
+		{name: "Whole balance out", userID: "user1", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":-100}`, expectedCode: http.StatusCreated},
+		{name: "Owner cannot deposit", userID: "user1", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":25}`, expectedCode: http.StatusForbidden, expectedBody: "Deposits take admin:write:all"},
+		{name: "Admin deposits", userID: "admin1", roles: []string{"admin"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":25}`, expectedCode: http.StatusCreated, expectedBody: `"amount":25`},
+		{name: "Overdraft", userID: "user1", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/1/transactions", body: `{"amount":-101}`, expectedCode: http.StatusUnprocessableEntity, expectedBody: "Insufficient balance"},
+		{name: "Joint owner lists", userID: "user4", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/2/transactions", expectedCode: http.StatusOK, expectedBody: `"id":"tx2"`},
+		{name: "Joint owner gets one", userID: "user4", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/2/transactions/tx2", expectedCode: http.StatusOK, expectedBody: `"amount":50`},
+		{name: "Joint owner creates", userID: "user4", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/2/transactions", body: `{"amount":-25}`, expectedCode: http.StatusCreated},
+		{name: "Household member lists", userID: "user7", scopes: []string{"user:read:self"}, method: http.MethodGet, url: "/accounts/2/transactions", expectedCode: http.StatusOK, expectedBody: `"id":"tx2"`},
+		{name: "Household member cannot create", userID: "user7", scopes: []string{"user:write:self"}, method: http.MethodPost, url: "/accounts/2/transactions", body: `{"amount":25}`, expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := setupRouter()
+			token, _ := generateJWT(tt.userID, tt.roles, tt.scopes)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(tt.method, tt.url, bytes.NewReader([]byte(tt.body)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			assert.Contains(t, w.Body.String(), tt.expectedBody)
+		})
+	}
+}
+
+// Admins with admin:read:all list every account's transactions, users those of the accounts they view
+func TestListTransactions(t *testing.T) {
+	r := setupRouter()
+
+	tests := []struct {
+		name     string
+		userID   string
+		roles    []string
+		scopes   []string
+		query    string
+		expected []string
+	}{
+		{name: "Admin", userID: "admin1", roles: []string{"admin"}, expected: []string{"tx1", "tx2"}},
+		{name: "Admin:read:all scope", userID: "admin1", scopes: []string{"admin:read:all"}, expected: []string{"tx1", "tx2"}},
+		{name: "Admin narrows to one account", userID: "admin1", roles: []string{"admin"}, query: "?account_id=2", expected: []string{"tx2"}},
+		{name: "User", userID: "user1", scopes: []string{"user:read:self"}, expected: []string{"tx1"}},
+		{name: "User asking for another account", userID: "user1", scopes: []string{"user:read:self"}, query: "?account_id=2", expected: []string{}},
+		{name: "User without transactions", userID: "user3", scopes: []string{"user:read:self"}, expected: []string{}},
+		{name: "Joint owner", userID: "user4", scopes: []string{"user:read:self"}, expected: []string{"tx2"}},
+		{name: "Nested household member", userID: "user7", scopes: []string{"user:read:self"}, expected: []string{"tx2"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			token, _ := generateJWT(tt.userID, tt.roles, tt.scopes)
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodGet, "/transactions"+tt.query, nil)
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+
+			var transactions []repository.Transaction
+			json.Unmarshal(w.Body.Bytes(), &transactions)
+			ids := []string{}
+			for _, tx := range transactions {
+				ids = append(ids, tx.ID)
+			}
+			assert.Equal(t, tt.expected, ids)
+		})
+	}
+}
+
+// Concurrent withdrawals never take more than the balance, run it with -race
+func TestConcurrentWithdrawals(t *testing.T) {
+	s := newMemoryServer()
+	r := s.router()
+	token := generateMockJWT("user1", []string{"user:write:self"})
+
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			req, _ := http.NewRequest(http.MethodPost, "/accounts/1/transactions", bytes.NewReader([]byte(`{"amount":-10}`)))
+			req.Header.Set("Authorization", "Bearer "+token)
+			r.ServeHTTP(w, req)
+			codes <- w.Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		assert.Contains(t, []int{http.StatusCreated, http.StatusUnprocessableEntity}, code)
+		if code == http.StatusCreated {
+			created++
+		}
+	}
+	assert.Equal(t, 10, created)
+	balance, _ := s.balance("1")
+	assert.Equal(t, 0.0, balance)
+}
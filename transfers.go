@@ -0,0 +1,123 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/gin-gonic/gin"
+)
+
+// transferKey is the gin context key the parsed TransferRequest is stored under
+const transferKey = "transfer"
+
+// TransferRequest moves Amount from one account to another
+type TransferRequest struct {
+	FromAccountID string  `json:"from_account_id" binding:"required"`
+	ToAccountID   string  `json:"to_account_id" binding:"required,nefield=FromAccountID"`
+	Amount        float64 `json:"amount" binding:"required,gt=0"`
+}
+
+// Transfer is a completed transfer, its two transactions share its id
+type Transfer struct {
+	ID     string                 `json:"id"`
+	Debit  repository.Transaction `json:"debit"`
+	Credit repository.Transaction `json:"credit"`
+}
+
+// transferRequest parses the body of POST /transfers once, the middleware
+// and the handler all read it. A malformed body answers 400.
+func transferRequest(c *gin.Context) (TransferRequest, bool) {
+	if req, ok := authz.Get[TransferRequest](c, transferKey); ok {
+		return req, true
+	}
+	var req TransferRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return req, false
+	}
+	c.Set(transferKey, req)
+	return req, true
+}
+
+// transferSource is the account a transfer debits, loadAccount loads it and
+// enforceRelations checks the caller owns it
+func transferSource(c *gin.Context) string {
+	req, _ := transferRequest(c)
+	return req.FromAccountID
+}
+
+// transferDestination is the account a transfer credits
+func transferDestination(c *gin.Context) string {
+	req, _ := transferRequest(c)
+	return "account:" + req.ToAccountID
+}
+
+// destinationExists answers 404 when the account a transfer credits does not
+// exist, before the depositor relation is checked on it
+func (s *server) destinationExists(c *gin.Context) {
+	req, _ := transferRequest(c)
+	if _, err := s.accounts.Get(req.ToAccountID); !saved(c, err) {
+		c.Abort()
+	}
+}
+
+// balance sums the transactions of an account
+func (s *server) balance(accountID string) (float64, error) {
+	transactions, err := s.transactions.ListByAccount(accountID)
+	if err != nil {
+		return 0, err
+	}
+	var balance float64
+	for _, t := range transactions {
+		balance += t.Amount
+	}
+	return balance, nil
+}
+
+// Transfer money between accounts. The caller needs owner on the source
+// and depositor on the destination, as relations.yaml says.
+func (s *server) createTransfer(c *gin.Context) {
+	source, _ := authz.GetResource[repository.Account](c)
+	req, _ := transferRequest(c)
+
+	// The accounts and the balance are checked and the money moved under the
+	// ledger lock, so no withdrawal, transfer or deletion comes in between
+	s.ledger.Lock()
+	defer s.ledger.Unlock()
+
+	for _, id := range []string{source.ID, req.ToAccountID} {
+		if _, err := s.accounts.Get(id); !saved(c, err) {
+			return
+		}
+	}
+	balance, err := s.balance(source.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if balance < req.Amount {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Insufficient balance"})
+		return
+	}
+
+	transferID := newTokenID()
+	createdAt := time.Now().UTC().Format(time.DateOnly)
+	debit, credit, err := s.transactions.Transfer(repository.Transaction{
+		AccountID:  source.ID,
+		Amount:     -req.Amount,
+		CreatedAt:  createdAt,
+		TransferID: transferID,
+	}, repository.Transaction{
+		AccountID:  req.ToAccountID,
+		Amount:     req.Amount,
+		CreatedAt:  createdAt,
+		TransferID: transferID,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusCreated, Transfer{ID: transferID, Debit: debit, Credit: credit})
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func transfer(r http.Handler, token, body string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	req, _ := http.NewRequest(http.MethodPost, "/transfers", bytes.NewReader([]byte(body)))
+	req.Header.Set("Authorization", "Bearer "+token)
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// The owner of the source sends money to an account they may deposit into
+func TestCreateTransfer(t *testing.T) {
+	tests := []struct {
+		name          string
+		userID        string
+		roles         []string
+		scopes        []string
+		body          string
+		expectedCode  int
+		expectedError string
+	}{
+		{name: "Owner to another customer", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"2","amount":40}`, expectedCode: http.StatusCreated},
+		{name: "Whole balance", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"3","amount":100}`, expectedCode: http.StatusCreated},
+		{name: "Insufficient balance", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"2","amount":150}`, expectedCode: http.StatusUnprocessableEntity, expectedError: "Insufficient balance"},
+		{name: "Read scope only", userID: "user1", scopes: []string{"user:read:self"}, body: `{"from_account_id":"1","to_account_id":"2","amount":40}`, expectedCode: http.StatusForbidden},
+		{name: "Not the owner of the source", userID: "user2", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"2","amount":40}`, expectedCode: http.StatusForbidden},
+		{name: "Joint owner of the source", userID: "user4", scopes: []string{"user:write:self"}, body: `{"from_account_id":"2","to_account_id":"1","amount":40}`, expectedCode: http.StatusCreated},
+		{name: "Viewer of the source", userID: "user5", scopes: []string{"user:write:self"}, body: `{"from_account_id":"3","to_account_id":"1","amount":40}`, expectedCode: http.StatusForbidden},
+		{name: "Admin of the bank owns every account", userID: "admin1", roles: []string{"admin"}, body: `{"from_account_id":"1","to_account_id":"2","amount":40}`, expectedCode: http.StatusCreated},
+		{name: "Missing source", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"9","to_account_id":"2","amount":40}`, expectedCode: http.StatusNotFound, expectedError: "Account not found"},
+		{name: "Missing destination", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"9","amount":40}`, expectedCode: http.StatusNotFound, expectedError: "Account not found"},
+		{name: "Same account", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"1","amount":40}`, expectedCode: http.StatusBadRequest},
+		{name: "Negative amount", userID: "user1", scopes: []string{"user:write:self"}, body: `{"from_account_id":"1","to_account_id":"2","amount":-40}`, expectedCode: http.StatusBadRequest},
+		{name: "Malformed body", userID: "user1", scopes: []string{"user:write:self"}, body: `{`, expectedCode: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := setupRouter()
+			token, _ := generateJWT(tt.userID, tt.roles, tt.scopes)
+			w := transfer(r, token, tt.body)
+			assert.Equal(t, tt.expectedCode, w.Code, w.Body.String())
+			if tt.expectedError != "" {
+				assert.Contains(t, w.Body.String(), tt.expectedError)
+			}
+		})
+	}
+}
+
+// A transfer records a debit and a credit sharing its id
+func TestTransferTransactions(t *testing.T) {
+	s := newMemoryServer()
+	r := s.router()
+	token := generateMockJWT("user1", []string{"user:write:self"})
+
+	w := transfer(r, token, `{"from_account_id":"1","to_account_id":"2","amount":40}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	var result Transfer
+	json.Unmarshal(w.Body.Bytes(), &result)
+
+	assert.NotEmpty(t, result.ID)
+	assert.Equal(t, result.ID, result.Debit.TransferID)
+	assert.Equal(t, result.ID, result.Credit.TransferID)
+	assert.Equal(t, "1", result.Debit.AccountID)
+	assert.Equal(t, -40.0, result.Debit.Amount)
+	assert.Equal(t, "2", result.Credit.AccountID)
+	assert.Equal(t, 40.0, result.Credit.Amount)
+
+	source, _ := s.balance("1")
+	destination, _ := s.balance("2")
+	assert.Equal(t, 60.0, source)
+	assert.Equal(t, 90.0, destination)
+}
+
+// Customers of the bank and the account's viewers may deposit, nobody else
+func TestDepositorRelation(t *testing.T) {
+	s := newMemoryServer()
+
+	tests := []struct {
+		name     string
+		subject  string
+		account  string
+		expected bool
+	}{
+		{name: "Customer", subject: "user:user1", account: "account:3", expected: true},
+		{name: "Delegated viewer", subject: "user:user5", account: "account:3", expected: true},
+		{name: "Neither", subject: "user:user5", account: "account:1", expected: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, err := s.relations.Check(tt.account, "depositor", tt.subject)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.expected, allowed)
+		})
+	}
+}
+
+// Concurrent transfers never spend the same balance twice, run it with -race
+func TestConcurrentTransfers(t *testing.T) {
+	s := newMemoryServer()
+	r := s.router()
+	token := generateMockJWT("user1", []string{"user:write:self"})
+
+	codes := make(chan int, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			codes <- transfer(r, token, `{"from_account_id":"1","to_account_id":"2","amount":10}`).Code
+		}()
+	}
+	wg.Wait()
+	close(codes)
+
+	created := 0
+	for code := range codes {
+		assert.Contains(t, []int{http.StatusCreated, http.StatusUnprocessableEntity}, code)
+		if code == http.StatusCreated {
+			created++
+		}
+	}
+	assert.Equal(t, 10, created)
+	balance, _ := s.balance("1")
+	assert.Equal(t, 0.0, balance)
+}
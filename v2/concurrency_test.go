@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Admins create accounts and profiles for many users at once, every one gets
+// its own id and its owner can read it. Run it with -race.
+func TestConcurrentCreates(t *testing.T) {
+	r := setupRouter()
+	const users = 32
+
+	var mu sync.Mutex
+	seen := map[string]bool{}
+	var wg sync.WaitGroup
+	for i := 0; i < users; i++ {
+		for _, kind := range []string{"account", "profile"} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				userID := fmt.Sprintf("stress%d", i)
+				payload := fmt.Sprintf(`{"%s":"new","user_id":"%s"}`, kind, userID)
+
+				w := makePostRequestWithToken(r, "/api/v1/"+kind+"s", generateTestJWT(Admin, "admin1"), strings.NewReader(payload))
+				if !assert.Equal(t, http.StatusCreated, w.Code, w.Body.String()) {
+					return
+				}
+				var created map[string]string
+				json.Unmarshal(w.Body.Bytes(), &created)
+				id := created[kind+"ID"]
+
+				mu.Lock()
+				assert.False(t, seen[kind+id], "%s %s was handed out twice", kind, id)
+				seen[kind+id] = true
+				mu.Unlock()
+
+				assert.Equal(t, http.StatusOK, makeRequestWithToken(r, http.MethodGet, "/api/v1/"+kind+"s/"+id, generateTestJWT(User, userID)).Code)
+			}()
+		}
+	}
+
+	// Meanwhile the owner keeps renaming a profile and an admin lists them
+	for i := 0; i < users; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req := httptest.NewRequest(http.MethodPut, "/api/v1/profiles/1", strings.NewReader(fmt.Sprintf(`{"profile":"name %d"}`, i)))
+			req.Header.Set("Authorization", "Bearer "+generateTestJWT(User, "1"))
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			assert.Equal(t, http.StatusOK, w.Code)
+			assert.Equal(t, http.StatusOK, makeRequestWithToken(r, http.MethodGet, "/api/v1/profiles", generateTestJWT(Admin, "admin1")).Code)
+		}()
+	}
+	wg.Wait()
+
+	assert.Len(t, seen, 2*users)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/conformance"
+	"github.com/anuchito/poc-api-permission/repository"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/stretchr/testify/assert"
+)
+
+// Every README scenario, they are written against this server's routes
+func TestConformance(t *testing.T) {
+	scenarios, err := conformance.Load("../README.md")
+	assert.NoError(t, err)
+
+	s := newMemoryServer()
+	conformance.Run(t, conformance.Program{
+		Router: s.router(),
+		Token: func(scenario conformance.Scenario) string {
+			claims := authz.Claims{
+				Role:   scenario.Role,
+				UserID: scenario.UserID,
+				RegisteredClaims: jwt.RegisteredClaims{
+					ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+				},
+			}
+			if scenario.Scope != "" {
+				claims.Scopes = []string{scenario.Scope}
+			}
+			token, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+			return token
+		},
+		Own: func(route, id, owner string) func() {
+			if strings.HasPrefix(route, "/api/v1/profiles/") {
+				return own(s.profiles, id, owner, func(p *repository.Profile) *string { return &p.UserID })
+			}
+			return own(s.accounts, id, owner, func(a *repository.Account) *string { return &a.UserID })
+		},
+		Skip: differs,
+	}, scenarios)
+}
+
+// differs are the README scenarios this server does not follow: any user
+// may list the profiles
+var differs = []string{
+	"Scenario 3: User Access to Admin-Only Profile Endpoint",
+}
+
+// own makes owner the owner of the record with id in repo, when there is one
+func own[T any](repo repository.Repository[T], id, owner string, userID func(record *T) *string) func() {
+	record, err := repo.Get(id)
+	if err != nil {
+		return func() {}
+	}
+	previous := *userID(&record)
+	*userID(&record) = owner
+	repo.Update(record)
+	return func() {
+		*userID(&record) = previous
+		repo.Update(record)
+	}
+}
@@ -1,232 +1,358 @@
 package main
 
 import (
+	"context"
+	_ "embed"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
-	"strings"
+	"path/filepath"
+	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/anuchito/poc-api-permission/authn"
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/anuchito/poc-api-permission/repository"
 	"github.com/gin-gonic/gin"
 )
 
-// Role
-type Role string
+// keyProvider verifies tokens, main replaces the development secret with the configured keys
+var keyProvider authn.KeyProvider = authn.NewKeySet(authn.NewHMACKey("", []byte("secret")))
 
-const (
-	Admin Role = "admin"
-	User  Role = "user"
-)
+// validation restricts which tokens are accepted, main overrides it from the
+// environment. Without JWT_ALGORITHMS a token must use the algorithm of the key
+// that verifies it, so keys the JWKS rotates in work without a restart
+var validation = authn.ValidationOptions{
+	Leeway: 30 * time.Second,
+}
+
+// defaultRoles lets admin read everything, writing other users' data takes
+// an explicit admin:write:all scope in the token
+var defaultRoles = authz.RoleConfig{Roles: map[string]authz.RoleDefinition{
+	"user":  {Scopes: []string{"user:read:self", "user:write:self"}},
+	"admin": {Inherits: []string{"user"}, Scopes: []string{"admin:read:all"}},
+}}
+
+// roleRegistry maps roles to the scopes they grant, main loads it from ROLES_FILE
+var roleRegistry = authz.MustRoleRegistry(defaultRoles)
+
+//go:embed policy.yaml
+var defaultPolicy []byte
 
-// Scope
-type Scope string
+// policies holds the route policy in force, policy.yaml until main loads POLICY_FILE
+var policies = authz.MustPolicyStore(defaultPolicy, roleRegistry, authz.DefaultMatcher)
 
+// Roles a token can carry
 const (
-	UserReadSelf  Scope = "user:read:self"
-	UserWriteSelf Scope = "user:write:self"
-	AdminReadAll  Scope = "admin:read:all"
-	AdminWriteAll Scope = "admin:write:all"
+	Admin = "admin"
+	User  = "user"
 )
 
-// Claims struct to define the JWT claims
-type Claims struct {
-	Role   Role   `json:"role"`
-	UserID string `json:"user_id"`
-	jwt.StandardClaims
+// Mock data for accounts and profiles, each belongs to the user with the same id
+var seedAccounts = []repository.Account{
+	{ID: "1", UserID: "1", Name: "Account 1"},
+	{ID: "2", UserID: "2", Name: "Account 2"},
 }
 
-// Mock data for accounts and profiles
-var accounts = map[string]string{
-	"1": "Account 1",
-	"2": "Account 2",
+var seedProfiles = []repository.Profile{
+	{ID: "1", UserID: "1", Name: "Profile 1"},
+	{ID: "2", UserID: "2", Name: "Profile 2"},
 }
 
-var profiles = map[string]string{
-	"1": "Profile 1",
-	"2": "Profile 2",
+// server holds the data the handlers work on, every router has its own
+type server struct {
+	accounts repository.AccountRepository
+	profiles repository.ProfileRepository
 }
 
-// Middleware to extract JWT token and set it in the context
-func jwtMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header is missing"})
-			c.Abort()
-			return
-		}
-
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid authorization header"})
-			c.Abort()
-			return
-		}
-
-		tokenString := parts[1]
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return []byte("secret"), nil
-		})
-
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired token"})
-			c.Abort()
-			return
-		}
-
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid claims"})
-			c.Abort()
-			return
-		}
-
-		// Set the claims into context for later use
-		c.Set("claims", claims)
-		c.Next()
+// newMemoryServer serves the mock data from memory
+func newMemoryServer() *server {
+	return &server{
+		accounts: repository.NewMemoryAccounts(seedAccounts...),
+		profiles: repository.NewMemoryProfiles(seedProfiles...),
 	}
 }
 
-// Middleware to check role
-func allowRoles(allow Role, mores ...Role) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		claims, _ := c.Get("claims")
-		if claims == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "No claims found"})
-			c.Abort()
-			return
-		}
-
-		userClaims := claims.(*Claims)
-
-		// Check if the user's role matches any of the allowed roles
-		roles := append(mores, allow)
-		roleAllowed := false
-		for _, role := range roles {
-			if userClaims.Role == role {
-				roleAllowed = true
-				break
-			}
-		}
-
-		if !roleAllowed {
-			c.JSON(http.StatusForbidden, gin.H{"error": "You don't have permission"})
-			c.Abort()
-			return
-		}
-
-		c.Next()
+// serverFromEnv keeps the data in JSON files in DATA_DIR, starting from the
+// mock data, or in memory when it is not set
+func serverFromEnv() (*server, error) {
+	dir := os.Getenv("DATA_DIR")
+	if dir == "" {
+		return newMemoryServer(), nil
+	}
+	accounts, err := repository.NewFileAccounts(filepath.Join(dir, "accounts.json"), seedAccounts...)
+	if err != nil {
+		return nil, err
+	}
+	profiles, err := repository.NewFileProfiles(filepath.Join(dir, "profiles.json"), seedProfiles...)
+	if err != nil {
+		return nil, err
 	}
+	return &server{accounts: accounts, profiles: profiles}, nil
 }
 
-// Middleware to check scope
-func allowScopes(scope Scope, more ...Scope) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		claims, _ := c.Get("claims")
-		if claims == nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "No claims found"})
-			c.Abort()
-			return
-		}
+// authenticate verifies the bearer JWT with the keys main configured
+func authenticate(_ context.Context, authHeader string) (*authz.Claims, error) {
+	return authz.VerifyBearer(authHeader, keyProvider, validation)
+}
 
-		userClaims := claims.(*Claims)
-
-		// Check if the user's scope is allowed
-		allowedScopes := append(more, scope)
-		scopeAllowed := false
-		for _, scope := range allowedScopes {
-			if scope == "user:read:self" && userClaims.UserID == c.Param("id") {
-				scopeAllowed = true
-				break
-			} else if scope == "admin:read:all" && userClaims.Role == Admin {
-				scopeAllowed = true
-				break
-			}
-		}
+// Middleware to check the caller's role and scopes against the route policy
+func allowPolicy(resource authz.ResourceFunc) gin.HandlerFunc {
+	return policies.Middleware(authz.ClaimsSubject, resource)
+}
 
-		if !scopeAllowed {
-			c.JSON(http.StatusForbidden, gin.H{"error": "Scope does not allow this action"})
-			c.Abort()
-			return
-		}
+// accountAttributes exposes the owner of an account to the policy
+func accountAttributes(a repository.Account) map[string]interface{} {
+	return map[string]interface{}{"id": a.ID, "user_id": a.UserID}
+}
 
-		c.Next()
-	}
+// profileAttributes exposes the owner of a profile to the policy
+func profileAttributes(p repository.Profile) map[string]interface{} {
+	return map[string]interface{}{"id": p.ID, "user_id": p.UserID}
 }
 
 // Handlers
-func getAccountsHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, accounts)
+func (s *server) getAccountsHandler(c *gin.Context) {
+	list, err := s.accounts.List()
+	if !saved(c, err) {
+		return
+	}
+	names := map[string]string{}
+	for _, a := range list {
+		names[a.ID] = a.Name
+	}
+	c.JSON(http.StatusOK, names)
 }
 
 func getAccountByIDHandler(c *gin.Context) {
-	id := c.Param("id")
-	account, exists := accounts[id]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Account not found"})
+	account, _ := authz.GetResource[repository.Account](c)
+	c.JSON(http.StatusOK, gin.H{"account": account.Name})
+}
+
+func (s *server) getProfilesHandler(c *gin.Context) {
+	list, err := s.profiles.List()
+	if !saved(c, err) {
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"account": account})
+	names := map[string]string{}
+	for _, p := range list {
+		names[p.ID] = p.Name
+	}
+	c.JSON(http.StatusOK, names)
 }
 
-func getProfilesHandler(c *gin.Context) {
-	c.JSON(http.StatusOK, profiles)
+func getProfileByIDHandler(c *gin.Context) {
+	profile, _ := authz.GetResource[repository.Profile](c)
+	c.JSON(http.StatusOK, gin.H{"profile": profile.Name})
 }
 
-func getProfileByIDHandler(c *gin.Context) {
-	id := c.Param("id")
-	profile, exists := profiles[id]
-	if !exists {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Profile not found"})
+func (s *server) updateProfileHandler(c *gin.Context) {
+	profile, _ := authz.GetResource[repository.Profile](c)
+
+	var profileData map[string]string
+	if err := c.ShouldBindJSON(&profileData); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"profile": profile})
+	if name, ok := profileData["profile"]; ok {
+		profile.Name = name
+		if !saved(c, s.profiles.Update(profile)) {
+			return
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"profile": profile.Name})
 }
 
-func createProfileHandler(c *gin.Context) {
+func (s *server) createProfileHandler(c *gin.Context) {
 	var profileData map[string]string
 	if err := c.ShouldBindJSON(&profileData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	profileID := fmt.Sprintf("%d", len(profiles)+1)
-	profiles[profileID] = profileData["profile"]
-	c.JSON(http.StatusCreated, gin.H{"profileID": profileID})
+	profile, err := s.profiles.Create(repository.Profile{UserID: ownerOf(c, profileData), Name: profileData["profile"]})
+	if !saved(c, err) {
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"profileID": profile.ID})
 }
 
-func createAccountHandler(c *gin.Context) {
+func (s *server) createAccountHandler(c *gin.Context) {
 	var accountData map[string]string
 	if err := c.ShouldBindJSON(&accountData); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	accountID := fmt.Sprintf("%d", len(accounts)+1)
-	accounts[accountID] = accountData["account"]
-	c.JSON(http.StatusCreated, gin.H{"accountID": accountID})
+	account, err := s.accounts.Create(repository.Account{UserID: ownerOf(c, accountData), Name: accountData["account"]})
+	if !saved(c, err) {
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{"accountID": account.ID})
 }
 
-// Main Router Setup
-func setupRouter() *gin.Engine {
-	r := gin.Default()
+// ownerOf returns the user_id in the payload, or the caller's when it has none
+func ownerOf(c *gin.Context, data map[string]string) string {
+	if owner := data["user_id"]; owner != "" {
+		return owner
+	}
+	claims, _ := authz.GetClaims(c)
+	return claims.UserID
+}
 
-	// Apply JWT middleware globally
-	r.Use(jwtMiddleware())
+// saved answers the request when a repository failed
+func saved(c *gin.Context, err error) bool {
+	switch {
+	case errors.Is(err, repository.ErrNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return false
+	case errors.Is(err, repository.ErrExists):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return false
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return false
+	}
+	return true
+}
 
-	// Define routes
-	r.GET("/api/v1/accounts", allowRoles(Admin), getAccountsHandler)
-	r.GET("/api/v1/accounts/:id", allowRoles(User, Admin), allowScopes(UserReadSelf, AdminReadAll), getAccountByIDHandler)
+// Main Router Setup, every call serves the mock data from scratch
+func setupRouter() *gin.Engine {
+	return newMemoryServer().router()
+}
+
+func (s *server) router() *gin.Engine {
+	r := gin.Default()
 
-	r.GET("/api/v1/profiles", allowRoles(User, Admin), getProfilesHandler)
-	r.GET("/api/v1/profiles/:id", allowRoles(User, Admin), allowScopes(UserReadSelf, AdminReadAll), getProfileByIDHandler)
-	r.POST("/api/v1/profiles", allowRoles(Admin), createProfileHandler)
-	r.POST("/api/v1/accounts", allowRoles(Admin), createAccountHandler)
+	// Authenticate every request, every route is authorized by policy.yaml
+	// after the account or profile in :id was loaded, so nothing runs for
+	// one that does not exist
+	r.Use(authz.ClaimsContext(authenticate))
+
+	accountRoutes := r.Group("/api/v1/accounts",
+		authz.LoadResource("id", s.accounts.Get, "Account not found"),
+		allowPolicy(authz.LoadedResource(accountAttributes)))
+	accountRoutes.GET("", s.getAccountsHandler)
+	accountRoutes.GET("/:id", getAccountByIDHandler)
+	accountRoutes.POST("", s.createAccountHandler)
+
+	profileRoutes := r.Group("/api/v1/profiles",
+		authz.LoadResource("id", s.profiles.Get, "Profile not found"),
+		allowPolicy(authz.LoadedResource(profileAttributes)))
+	profileRoutes.GET("", s.getProfilesHandler)
+	profileRoutes.GET("/:id", getProfileByIDHandler)
+	profileRoutes.PUT("/:id", s.updateProfileHandler)
+	profileRoutes.POST("", s.createProfileHandler)
 
 	return r
 }
 
 func main() {
 	fmt.Println("Starting server...")
-	r := setupRouter()
+	devMode, err := authn.DevModeFromEnv()
+	if err != nil {
+		fmt.Println("Invalid DEV_TOKEN_ENDPOINT:", err)
+		os.Exit(1)
+	}
+
+	ks, err := authn.KeySetFromEnv()
+	switch {
+	case errors.Is(err, authn.ErrNoKeys):
+	case err != nil:
+		fmt.Println("Failed to load signing keys:", err)
+		os.Exit(1)
+	default:
+		keyProvider = ks
+	}
+
+	jwks, err := authn.JWKSFromEnv(authn.WithErrorLog(func(err error) {
+		fmt.Println("JWKS refresh failed:", err)
+	}))
+	switch {
+	case errors.Is(err, authn.ErrNoKeys):
+	case err != nil:
+		fmt.Println("Failed to load JWKS:", err)
+		os.Exit(1)
+	default:
+		jwks.Start()
+		defer jwks.Stop()
+		// Local keys stay valid next to the issuer's only when explicitly configured
+		if ks != nil {
+			keyProvider = authn.Providers{jwks, ks}
+		} else {
+			keyProvider = jwks
+		}
+	}
+
+	// Anyone can sign tokens with the development secret, admin tokens included
+	switch {
+	case !devMode && ks == nil && jwks == nil:
+		fmt.Println("No signing key configured. Set JWT_SECRET, JWT_SECRET_FILE, JWT_PRIVATE_KEY_FILE or JWT_JWKS_URL, or DEV_TOKEN_ENDPOINT=true to use the development secret")
+		os.Exit(1)
+	case devMode && (ks != nil || jwks != nil):
+		fmt.Println("DEV_TOKEN_ENDPOINT is refused when signing keys or a JWKS are configured")
+		os.Exit(1)
+	case devMode:
+		fmt.Println("Development mode, tokens signed with the development secret are accepted")
+	}
+
+	validation, err = authn.ValidationOptionsFromEnv(validation)
+	if err != nil {
+		fmt.Println("Invalid token validation options:", err)
+		os.Exit(1)
+	}
+
+	roleRegistry, err = authz.RoleRegistryFromEnv(roleRegistry)
+	if err != nil {
+		fmt.Println("Failed to load roles:", err)
+		os.Exit(1)
+	}
+
+	policies, err = authz.PolicyStoreFromEnv(defaultPolicy, roleRegistry, authz.DefaultMatcher)
+	if err != nil {
+		fmt.Println("Failed to load policy:", err)
+		os.Exit(1)
+	}
+	interval, err := authz.ReloadIntervalFromEnv()
+	if err != nil {
+		fmt.Println("Invalid POLICY_RELOAD_INTERVAL:", err)
+		os.Exit(1)
+	}
+	policies.Logf = log.Printf
+	if path := os.Getenv("POLICY_FILE"); path != "" {
+		policies.Watch(path, interval)
+		defer policies.Stop()
+	}
+
+	// A candidate policy is only logged and counted, the policy above still decides
+	if policies.Shadow, err = authz.ShadowFromEnv(roleRegistry, authz.DefaultMatcher); err != nil {
+		fmt.Println("Failed to load the shadow policy:", err)
+		os.Exit(1)
+	}
+	if policies.Shadow != nil {
+		policies.Shadow.Candidate.Logf = log.Printf
+		policies.Shadow.Candidate.Watch(os.Getenv("SHADOW_POLICY_FILE"), interval)
+		defer policies.Shadow.Candidate.Stop()
+	}
+
+	if policies.Debug, err = authz.DebugFromEnv(); err != nil {
+		fmt.Println("Invalid AUTHZ_DEBUG:", err)
+		os.Exit(1)
+	}
+	logDecisions, err := authz.LogDecisionsFromEnv()
+	if err != nil {
+		fmt.Println("Invalid AUTHZ_LOG_DECISIONS:", err)
+		os.Exit(1)
+	}
+	if logDecisions {
+		policies.LogDecision = authz.PrintDecision
+	}
+
+	s, err := serverFromEnv()
+	if err != nil {
+		fmt.Println("Failed to load data:", err)
+		os.Exit(1)
+	}
+	r := s.router()
 
 	port := "8080"
 	if p := os.Getenv("PORT"); p != "" {
@@ -8,17 +8,18 @@ import (
 	"testing"
 	"time"
 
-	"github.com/dgrijalva/jwt-go"
+	"github.com/anuchito/poc-api-permission/authz"
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/stretchr/testify/assert"
 )
 
 // Helper function to generate a test JWT token
-func generateTestJWT(role Role, userID string) string {
-	claims := Claims{
+func generateTestJWT(role string, userID string) string {
+	claims := authz.Claims{
 		Role:   role,
 		UserID: userID,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: time.Now().Add(time.Hour).Unix(),
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
 		},
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
@@ -96,3 +97,29 @@ func TestCreateProfile(t *testing.T) {
 	resp := makePostRequestWithToken(r, "/api/v1/profiles", token, strings.NewReader(`{"profile": "test"}`))
 	assert.Equal(t, http.StatusCreated, resp.Code)
 }
+
+// README scenarios for self and all scopes
+func TestAllowScopes(t *testing.T) {
+	r := setupRouter()
+
+	tests := []struct {
+		name         string
+		role         string
+		userID       string
+		url          string
+		expectedCode int
+	}{
+		{name: "Admin reads any account with admin:read:all", role: Admin, userID: "admin1", url: "/api/v1/accounts/2", expectedCode: http.StatusOK},
+		{name: "User reads own account with user:read:self", role: User, userID: "1", url: "/api/v1/accounts/1", expectedCode: http.StatusOK},
+		{name: "User cannot read another user's account", role: User, userID: "1", url: "/api/v1/accounts/2", expectedCode: http.StatusForbidden},
+		{name: "User reads own profile with user:read:self", role: User, userID: "1", url: "/api/v1/profiles/1", expectedCode: http.StatusOK},
+		{name: "User cannot read another user's profile", role: User, userID: "1", url: "/api/v1/profiles/2", expectedCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := makeRequestWithToken(r, http.MethodGet, tt.url, generateTestJWT(tt.role, tt.userID))
+			assert.Equal(t, tt.expectedCode, resp.Code)
+		})
+	}
+}